@@ -0,0 +1,100 @@
+package main
+
+import "log"
+
+// Changes to a pool are saved by group commit. A change made while the
+// pool is being saved joins the next batch, and every change in a batch
+// is written with a single save once the previous one is done. The
+// pool is unlocked while it is being saved, so that other requests may
+// add to the next batch. Pools in a SharedStore are not saved this way,
+// see updateShared().
+
+// A commitBatch is a set of changes which are saved together.
+type commitBatch struct {
+	before   poolState // the state of the pool before the first change
+	finished bool
+	err      error
+}
+
+// commit saves the changes made to p, waiting until they are written.
+// before is the state of p before the changes, and is used if this is
+// the first change in a batch. If the save fails, every change in the
+// batch, and any made after them, is undone and a *StoreError is
+// returned.
+// expects the caller to be holding the lock on p
+func (p *pool) commit(before poolState) error {
+	if p.batch == nil {
+		p.batch = &commitBatch{before: before}
+	}
+	return p.waitFor(p.batch)
+}
+
+// waitForBatch waits until the changes made to p so far are written,
+// without adding to them. It returns the error of the batch they are in.
+// expects the caller to be holding the lock on p
+func (p *pool) waitForBatch() error {
+	if p.batch != nil {
+		return p.waitFor(p.batch)
+	}
+	if p.writing != nil {
+		return p.waitFor(p.writing)
+	}
+	return nil
+}
+
+// waitFor waits until the batch b has been saved, writing it if no other
+// request is, and returns its error.
+// expects the caller to be holding the lock on p
+func (p *pool) waitFor(b *commitBatch) error {
+	for !b.finished {
+		if !p.saving && p.batch == b {
+			p.writeBatch()
+		} else {
+			p.saved.Wait()
+		}
+	}
+	return b.err
+}
+
+// writeBatch saves the pending batch of p.
+// expects the caller to be holding the lock on p
+func (p *pool) writeBatch() {
+	b := p.batch
+	p.batch = nil
+	p.saving = true
+	p.writing = b
+	pi := p.saveInfo()
+	p.Unlock()
+	err := p.store.SavePool(p.name, pi)
+	p.Lock()
+	p.saving = false
+	p.writing = nil
+	b.finished = true
+	if err != nil {
+		log.Printf("Error saving pool %s, undoing the change: %s", p.name, err.Error())
+		b.err = &StoreError{Name: p.name, Err: err}
+		p.restore(b.before)
+		p.degraded = true
+		// changes made during the save were made on top of this batch
+		if p.batch != nil {
+			p.batch.err = b.err
+			p.batch.finished = true
+			p.batch = nil
+		}
+	} else {
+		p.degraded = false
+	}
+	p.saved.Broadcast()
+}
+
+// waitForSaves waits until every change to p has been saved or undone.
+// expects the caller to be holding the lock on p
+func (p *pool) waitForSaves() {
+	for p.saving || p.batch != nil {
+		if !p.saving {
+			p.writeBatch()
+			continue
+		}
+		p.saved.Wait()
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Exclusions lists the ids a pool must never mint. An id is excluded if
+// it is in Ids, if it matches one of the regular expressions in Patterns,
+// or if Words is set and it contains a word from the built-in list.
+type Exclusions struct {
+	Ids      []string `json:",omitempty"`
+	Patterns []string `json:",omitempty"`
+	Words    bool     `json:",omitempty"`
+}
+
+// IsEmpty returns true if e excludes nothing.
+func (e *Exclusions) IsEmpty() bool {
+	return e == nil || (len(e.Ids) == 0 && len(e.Patterns) == 0 && !e.Words)
+}
+
+// exclusionFilter is the compiled form of an Exclusions
+type exclusionFilter struct {
+	ids      map[string]bool
+	patterns []*regexp.Regexp
+	words    bool
+}
+
+// newExclusionFilter compiles e. It returns nil if e excludes nothing.
+func newExclusionFilter(e *Exclusions) (*exclusionFilter, error) {
+	if e.IsEmpty() {
+		return nil, nil
+	}
+	f := &exclusionFilter{
+		ids:   make(map[string]bool),
+		words: e.Words,
+	}
+	for _, id := range e.Ids {
+		f.ids[id] = true
+	}
+	for _, s := range e.Patterns {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("Bad exclusion pattern %q: %s", s, err.Error())
+		}
+		f.patterns = append(f.patterns, re)
+	}
+	return f, nil
+}
+
+// excluded returns true if the pool should not mint id.
+func (f *exclusionFilter) excluded(id string) bool {
+	if f.ids[id] {
+		return true
+	}
+	for _, re := range f.patterns {
+		if re.MatchString(id) {
+			return true
+		}
+	}
+	return f.words && containsWord(id)
+}
+
+// Noid digits have no vowels, but digits may stand in for letters.
+var leetReplacer = strings.NewReplacer(
+	"0", "o",
+	"1", "i",
+	"3", "e",
+	"4", "a",
+	"5", "s",
+	"7", "t",
+)
+
+// excludedWords is the built-in word list. It is kept short on purpose,
+// since every entry removes many ids from a pool. Entries without vowels
+// match ids as minted, and the others match once digits are read as
+// letters, e.g. "5h1t".
+var excludedWords = []string{
+	// consonant skeletons
+	"fck", "fkk", "sht", "cnt", "dck", "ckk", "twt", "wnk", "fgt", "nzz",
+	"kkk", "xxx", "prn", "pss", "dmn",
+	// with vowels
+	"fuck", "shit", "cunt", "dick", "cock", "piss", "twat", "wank", "fag",
+	"nazi", "rape", "slut", "whore", "bitch", "damn", "porn", "sex", "ass",
+	"tit", "kike", "spic", "coon", "homo", "dyke", "hitler",
+}
+
+func containsWord(id string) bool {
+	id = strings.ToLower(id)
+	leet := leetReplacer.Replace(id)
+	for _, w := range excludedWords {
+		if strings.Contains(id, w) || strings.Contains(leet, w) {
+			return true
+		}
+	}
+	return false
+}
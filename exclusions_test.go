@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestExclusionFilter(t *testing.T) {
+	f, err := newExclusionFilter(&Exclusions{
+		Ids:      []string{"bb12"},
+		Patterns: []string{"^x", "9$"},
+		Words:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		id       string
+		excluded bool
+	}{
+		{"bb12", true},
+		{"bb13", false},
+		{"xbcd", true},
+		{"bcd9", true},
+		{"qfck2", true},
+		{"b5h17", true},
+		{"shft", false},
+	}
+	for _, test := range tests {
+		if f.excluded(test.id) != test.excluded {
+			t.Errorf("excluded(%q) != %v\n", test.id, test.excluded)
+		}
+	}
+
+	_, err = newExclusionFilter(&Exclusions{Patterns: []string{"("}})
+	if err == nil {
+		t.Errorf("Expected error for bad pattern\n")
+	}
+	f, _ = newExclusionFilter(&Exclusions{})
+	if f != nil {
+		t.Errorf("Expected nil filter for empty exclusions\n")
+	}
+}
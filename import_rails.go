@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/ndlib/noids/noid"
+)
+
+// railsMinterState is a row of the minter_states table used by the
+// noid-rails gem to save the state of its minters.
+type railsMinterState struct {
+	Namespace string
+	Template  string
+	Counters  []noid.Counter
+	Seq       *big.Int
+}
+
+// railsCounter is how noid-rails serializes a counter
+type railsCounter struct {
+	Value *big.Int `json:"value"`
+	Max   *big.Int `json:"max"`
+}
+
+// railsDumpRow is a row of the minter_states table as exported by e.g.
+// `MinterState.all.to_json`. The counters column is a JSON string, but we
+// also allow it to be an array.
+type railsDumpRow struct {
+	Namespace string          `json:"namespace"`
+	Template  string          `json:"template"`
+	Counters  json.RawMessage `json:"counters"`
+	Seq       *big.Int        `json:"seq"`
+}
+
+// importRails implements the import-rails command, which creates a pool
+// for every minter in a noid-rails minter_states table.
+func importRails(store PoolStore, args []string) error {
+	var dryRun bool
+
+	fs := flag.NewFlagSet("import-rails", flag.ExitOnError)
+	fs.BoolVar(&dryRun, "dry-run", false, "only display the pools which would be created")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, `usage: noids [storage options] import-rails [-dry-run] <source>
+
+Creates a pool for every minter in a noid-rails minter_states table.
+The pool has the same name as the minter's namespace. The source is one of
+
+    sqlite:<database file>
+    mysql:<user:password@tcp(hostname:port)/database>
+    <JSON file>
+
+where the JSON file is a dump of the table, e.g. the output of
+'MinterState.all.to_json'.`)
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("import-rails takes one source")
+	}
+	if store == nil && !dryRun {
+		return errors.New("import-rails needs a storage option to save the pools to")
+	}
+
+	states, err := loadRailsSource(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	pg := NewPoolGroup()
+	if !dryRun {
+		DefaultStore = store
+		err = pg.LoadPoolsFromStore(store)
+		if err != nil {
+			return err
+		}
+	}
+	for _, state := range states {
+		template, err := railsTemplate(state)
+		if err != nil {
+			fmt.Printf("%s\tskipped: %s\n", state.Namespace, err.Error())
+			continue
+		}
+		if dryRun {
+			fmt.Printf("%s\t%s\n", state.Namespace, template)
+			continue
+		}
+		pi, err := pg.AddPool(state.Namespace, template)
+		if err != nil {
+			fmt.Printf("%s\tskipped: %s\n", state.Namespace, err.Error())
+			continue
+		}
+		fmt.Printf("%s\t%s\tcreated\n", pi.Name, pi.Template)
+	}
+	return nil
+}
+
+// railsTemplate returns the extended template for a pool which will not
+// mint any of the ids already minted by the noid-rails minter.
+func railsTemplate(state railsMinterState) (string, error) {
+	pos, err := noid.LegacyPosition(state.Template, state.Seq, state.Counters)
+	if err != nil {
+		return "", err
+	}
+	return state.Template + "+" + pos.String(), nil
+}
+
+func loadRailsSource(source string) ([]railsMinterState, error) {
+	switch {
+	case strings.HasPrefix(source, "sqlite:"):
+		return loadRailsDatabase("sqlite3", strings.TrimPrefix(source, "sqlite:"))
+	case strings.HasPrefix(source, "mysql:"):
+		return loadRailsDatabase("mysql", strings.TrimPrefix(source, "mysql:"))
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rows []railsDumpRow
+	err = json.NewDecoder(f).Decode(&rows)
+	if err != nil {
+		return nil, err
+	}
+	var result []railsMinterState
+	for _, row := range rows {
+		counters := row.Counters
+		// the counters column is usually a string holding JSON
+		var s string
+		if json.Unmarshal(counters, &s) == nil {
+			counters = json.RawMessage(s)
+		}
+		state, err := newRailsMinterState(row.Namespace, row.Template, string(counters), row.Seq)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, state)
+	}
+	return result, nil
+}
+
+func loadRailsDatabase(driver, location string) ([]railsMinterState, error) {
+	db, err := sql.Open(driver, location)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return readRailsStates(db)
+}
+
+func readRailsStates(db *sql.DB) ([]railsMinterState, error) {
+	var result []railsMinterState
+
+	rows, err := db.Query("SELECT namespace, template, counters, seq FROM minter_states")
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var namespace, template, counters, seq sql.NullString
+		err := rows.Scan(&namespace, &template, &counters, &seq)
+		if err != nil {
+			return result, err
+		}
+		n := new(big.Int)
+		if seq.Valid {
+			if _, ok := n.SetString(seq.String, 10); !ok {
+				return result, fmt.Errorf("minter %s: bad seq %q", namespace.String, seq.String)
+			}
+		}
+		state, err := newRailsMinterState(namespace.String, template.String, counters.String, n)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, state)
+	}
+	return result, rows.Err()
+}
+
+func newRailsMinterState(namespace, template, counters string, seq *big.Int) (railsMinterState, error) {
+	state := railsMinterState{
+		Namespace: namespace,
+		Template:  template,
+		Seq:       seq,
+	}
+	if state.Seq == nil {
+		state.Seq = new(big.Int)
+	}
+	if counters == "" || counters == "null" {
+		return state, nil
+	}
+	var rcs []railsCounter
+	err := json.Unmarshal([]byte(counters), &rcs)
+	if err != nil {
+		return state, fmt.Errorf("minter %s: %s", namespace, err.Error())
+	}
+	for _, rc := range rcs {
+		if rc.Value == nil || rc.Max == nil {
+			return state, fmt.Errorf("minter %s: counter is missing a value or max", namespace)
+		}
+		state.Counters = append(state.Counters, noid.Counter{Value: rc.Value, Max: rc.Max})
+	}
+	return state, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const railsSchema = `CREATE TABLE minter_states (
+id INTEGER PRIMARY KEY,
+namespace VARCHAR(255) NOT NULL DEFAULT 'default',
+template VARCHAR(255) NOT NULL,
+counters TEXT,
+seq BIGINT DEFAULT 0,
+rand BLOB,
+created_at DATETIME,
+updated_at DATETIME
+);`
+
+func TestImportRailsDatabase(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Skip(err)
+		return
+	}
+	defer db.Close()
+
+	_, err = db.Exec(railsSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A .reek minter has 281 counters of 3 ids each, except the last
+	// which has 1. The first counter has been used once and the second twice.
+	var counters []string
+	for i := 0; i < 281; i++ {
+		value := 3 * i
+		switch i {
+		case 0:
+			value++
+		case 1:
+			value += 2
+		}
+		top := 3*i + 3
+		if top > 841 {
+			top = 841
+		}
+		counters = append(counters, fmt.Sprintf(`{"value":%d,"max":%d}`, value, top))
+	}
+	_, err = db.Exec(`INSERT INTO minter_states (namespace, template, counters, seq) VALUES
+		('default', '.reek', ?, 3),
+		('sequential', '.sddd', NULL, 20),
+		('fresh', '.reek', NULL, 0)`,
+		"["+strings.Join(counters, ",")+"]")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	states, err := readRailsStates(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"default":    ".reek+283",
+		"sequential": ".sddd+20",
+		"fresh":      ".reek+0",
+	}
+	if len(states) != len(expected) {
+		t.Fatalf("Got %v\n", states)
+	}
+	for _, state := range states {
+		template, err := railsTemplate(state)
+		if err != nil {
+			t.Errorf("%s: %v\n", state.Namespace, err)
+		}
+		if template != expected[state.Namespace] {
+			t.Errorf("%s: template %s, expected %s\n", state.Namespace, template, expected[state.Namespace])
+		}
+	}
+}
+
+func TestImportRailsDump(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "dump.json")
+	err := ioutil.WriteFile(fname, []byte(`[
+		{"id":1,"namespace":"default","template":".sdd","counters":null,"seq":7,"rand":null},
+		{"id":2,"namespace":"random","template":".rdd","counters":"[{\"value\":0,\"max\":1},{\"value\":1,\"max\":2}]","seq":0}
+	]`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states, err := loadRailsSource(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 2 || states[0].Seq.Int64() != 7 || len(states[1].Counters) != 2 {
+		t.Fatalf("Got %v\n", states)
+	}
+
+	store := NewJsonFileStore(t.TempDir())
+	defer func() { DefaultStore = NullStore{} }()
+	err = importRails(store, []string{fname})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pis, err := store.LoadAllPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pis) != 2 {
+		t.Errorf("Got %v\n", pis)
+	}
+	for _, pi := range pis {
+		if pi.Name == "default" && pi.Template != ".sdd+7" {
+			t.Errorf("Got %v\n", pi)
+		}
+	}
+}
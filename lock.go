@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// A Locker is a PoolStore which only one server should use at a time.
+// Lock takes the lock, and keeps it until the returned function is called.
+// If another server has the lock, the error wraps StoreLocked and names it.
+type Locker interface {
+	Lock() (func(), error)
+}
+
+var StoreLocked = errors.New("Storage is in use by another server")
+
+// lockHolder describes this process, for the error another server gets.
+func lockHolder() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("process %d on host %s", os.Getpid(), host)
+}
+
+const dbLockSchema = `CREATE TABLE IF NOT EXISTS noids_lock (
+id INTEGER PRIMARY KEY,
+token VARCHAR(64),
+holder VARCHAR(255),
+expires BIGINT
+);`
+
+// lockLease is how long a database lock lasts if it is not renewed, e.g.
+// because the server holding it crashed. It is renewed three times as often.
+var lockLease = 30 * time.Second
+
+// leaseLock is a lock on a database, kept as the single row of the
+// noids_lock table. rebind changes the "?" placeholders in a query into
+// the ones the database uses.
+type leaseLock struct {
+	db      *sql.DB
+	rebind  func(string) string
+	token   string
+	lease   time.Duration
+	renewed time.Time
+}
+
+func takeLeaseLock(db *sql.DB, rebind func(string) string) (func(), error) {
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	if err != nil {
+		return nil, err
+	}
+	l := &leaseLock{db: db, rebind: rebind, token: hex.EncodeToString(token), lease: lockLease}
+	err = l.take()
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		l.keep(done)
+		close(stopped)
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		_, err := l.db.Exec(l.rebind("DELETE FROM noids_lock WHERE id = 1 AND token = ?"), l.token)
+		if err != nil {
+			log.Println("Error releasing lock:", err.Error())
+		}
+	}, nil
+}
+
+// take takes the lock if no one has it, or if its lease has run out.
+func (l *leaseLock) take() error {
+	now := time.Now()
+	expires := now.Add(l.lease).UnixNano()
+	holder := lockHolder()
+	result, err := l.db.Exec(l.rebind("UPDATE noids_lock SET token = ?, holder = ?, expires = ? WHERE id = 1 AND expires < ?"),
+		l.token, holder, expires, now.UnixNano())
+	if err != nil {
+		return err
+	}
+	nrows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if nrows == 0 {
+		var other string
+		err = l.db.QueryRow("SELECT holder FROM noids_lock WHERE id = 1").Scan(&other)
+		if err == nil {
+			return fmt.Errorf("%w: %s", StoreLocked, other)
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+		_, err = l.db.Exec(l.rebind("INSERT INTO noids_lock (id, token, holder, expires) VALUES (1, ?, ?, ?)"),
+			l.token, holder, expires)
+		if err != nil {
+			// another server may have inserted the row first
+			if l.db.QueryRow("SELECT holder FROM noids_lock WHERE id = 1").Scan(&other) == nil {
+				return fmt.Errorf("%w: %s", StoreLocked, other)
+			}
+			return err
+		}
+	}
+	l.renewed = now
+	return nil
+}
+
+// renew extends the lease. It returns StoreLocked if the lock was lost.
+func (l *leaseLock) renew() error {
+	now := time.Now()
+	result, err := l.db.Exec(l.rebind("UPDATE noids_lock SET expires = ? WHERE id = 1 AND token = ?"),
+		now.Add(l.lease).UnixNano(), l.token)
+	if err != nil {
+		return err
+	}
+	nrows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if nrows == 0 {
+		return StoreLocked
+	}
+	l.renewed = now
+	return nil
+}
+
+// keep renews the lease until done is closed. The server stops if the
+// lease runs out, since another server may then take the lock.
+func (l *leaseLock) keep(done <-chan struct{}) {
+	ticker := time.NewTicker(l.lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		err := l.renew()
+		if err == StoreLocked || (err != nil && time.Since(l.renewed) > l.lease) {
+			log.Fatalln("Lost the lock on the database:", err.Error())
+		} else if err != nil {
+			log.Println("Error renewing lock:", err.Error())
+		}
+	}
+}
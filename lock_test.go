@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDirLock(t *testing.T) {
+	dir := t.TempDir()
+	unlock, err := NewJsonFileStore(dir).(Locker).Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewJsonFileStore(dir).(Locker).Lock()
+	if !errors.Is(err, StoreLocked) || !strings.Contains(err.Error(), lockHolder()) {
+		t.Errorf("Expected StoreLocked, got %v", err)
+	}
+	// the lock file is not a pool
+	pis, err := NewJsonFileStore(dir).LoadAllPools()
+	if err != nil || len(pis) != 0 {
+		t.Errorf("Got %v, %v", pis, err)
+	}
+	unlock()
+	unlock, err = NewJsonFileStore(dir).(Locker).Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
+
+func TestDbLock(t *testing.T) {
+	defer func(lease time.Duration) { lockLease = lease }(lockLease)
+	lockLease = 300 * time.Millisecond
+
+	// two servers, sharing a connection so sqlite's file locks do not
+	// get in the way
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "noids.sqlite"))
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	stores := []Locker{NewDbFileStore(db).(Locker), NewDbFileStore(db).(Locker)}
+
+	unlock, err := stores[0].Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the lease is renewed, so it is still held after it would have run out
+	time.Sleep(2 * lockLease)
+	_, err = stores[1].Lock()
+	if !errors.Is(err, StoreLocked) || !strings.Contains(err.Error(), lockHolder()) {
+		t.Errorf("Expected StoreLocked, got %v", err)
+	}
+	unlock()
+	unlock, err = stores[1].Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
+
+func TestDbLockExpired(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	store := NewDbFileStore(db).(Locker)
+
+	// a server which crashed left its lock behind
+	unlock, err := store.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("UPDATE noids_lock SET token = 'old', expires = ?", time.Now().Add(-time.Second).UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	unlock, err = store.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
+
+func TestDbLockRace(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	NewDbFileStore(db)
+
+	// another server inserts the row just before this one does
+	rebind := func(query string) string {
+		if strings.HasPrefix(query, "INSERT") {
+			db.Exec("INSERT INTO noids_lock (id, token, holder, expires) VALUES (1, 'x', 'the other server', ?)",
+				time.Now().Add(time.Minute).UnixNano())
+		}
+		return query
+	}
+	l := &leaseLock{db: db, rebind: rebind, token: "y", lease: time.Minute}
+	err = l.take()
+	if !errors.Is(err, StoreLocked) || !strings.Contains(err.Error(), "the other server") {
+		t.Errorf("Expected StoreLocked, got %v", err)
+	}
+}
@@ -2,18 +2,22 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"net/url"
 	"os"
 	"os/signal"
 	"regexp"
+	"sync"
 	"syscall"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/getsentry/sentry-go"
 	"gopkg.in/gcfg.v1"
@@ -58,6 +62,7 @@ func signalHandler(sig <-chan os.Signal, logw Reopener) {
 			logw.Reopen()
 		case syscall.SIGINT, syscall.SIGTERM:
 			log.Println("Exiting")
+			unlockStore()
 			if pidfilename != "" {
 				// we don't care if there is an error
 				os.Remove(pidfilename)
@@ -80,8 +85,10 @@ func writePID(fname string) {
 
 type Config struct {
 	General struct {
-		Port       string
-		StorageDir string
+		Port              string
+		StorageDir        string
+		BoltFile          string
+		IdempotencyWindow string
 	}
 	Mysql struct {
 		User     string
@@ -90,12 +97,49 @@ type Config struct {
 		Port     string
 		Database string
 	}
+	Postgres struct {
+		User     string
+		Password string
+		Host     string
+		Port     string
+		Database string
+		SSLMode  string
+	}
 }
 
 var (
 	pidfilename string
+
+	// storeUnlock releases the lock on the pool storage, if there is one
+	storeUnlock   func()
+	storeUnlockMu sync.Mutex
 )
 
+// lockStore takes the lock on store, if it has one, so that no other
+// server uses it at the same time.
+func lockStore(store PoolStore) {
+	locker, ok := store.(Locker)
+	if !ok {
+		return
+	}
+	unlock, err := locker.Lock()
+	if err != nil {
+		log.Fatalf("Error locking the pool storage: %s", err.Error())
+	}
+	storeUnlockMu.Lock()
+	storeUnlock = unlock
+	storeUnlockMu.Unlock()
+}
+
+func unlockStore() {
+	storeUnlockMu.Lock()
+	defer storeUnlockMu.Unlock()
+	if storeUnlock != nil {
+		storeUnlock()
+		storeUnlock = nil
+	}
+}
+
 func main() {
 	var (
 		port          string
@@ -103,8 +147,13 @@ func main() {
 		logfilename   string
 		logw          Reopener
 		sqliteFile    string
+		boltFile      string
 		mysqlLocation string
+		pgLocation    string
 		showVersion   bool
+		shared        bool
+		raftConfig    RaftConfig
+		raftPeers     string
 		configFile    string
 		config        Config
 	)
@@ -113,10 +162,18 @@ func main() {
 	flag.StringVar(&logfilename, "log", "", "name of log file")
 	flag.StringVar(&storageDir, "storage", "", "directory to save noid information")
 	flag.StringVar(&sqliteFile, "sqlite", "", "sqlite database file to save noid information")
+	flag.StringVar(&boltFile, "bolt", "", "bolt file to save noid information")
 	flag.StringVar(&mysqlLocation, "mysql", "", "MySQL database to save noid information")
+	flag.StringVar(&pgLocation, "postgres", "", "PostgreSQL database to save noid information")
 	flag.BoolVar(&showVersion, "version", false, "Display binary version")
 	flag.StringVar(&configFile, "config", "", "config file to use")
 	flag.StringVar(&pidfilename, "pid", "", "file to store pid of server")
+	flag.BoolVar(&shared, "shared", false, "share the database with other noids servers")
+	flag.StringVar(&raftConfig.Dir, "raft-dir", "", "directory to keep the raft log, to run as part of a cluster")
+	flag.StringVar(&raftConfig.ID, "raft-id", "", "name of this server in the raft cluster")
+	flag.StringVar(&raftConfig.Addr, "raft-addr", "", "host:port to use for raft traffic")
+	flag.StringVar(&raftPeers, "raft-peers", "", "every server in the raft cluster, as id=host:port=url,...")
+	flag.DurationVar(&IdempotencyWindow, "idempotency-window", IdempotencyWindow, "how long to remember the Idempotency-Key of a mint request")
 
 	flag.Parse()
 
@@ -158,6 +215,15 @@ func main() {
 		if config.General.StorageDir != "" {
 			storageDir = config.General.StorageDir
 		}
+		if config.General.BoltFile != "" {
+			boltFile = config.General.BoltFile
+		}
+		if config.General.IdempotencyWindow != "" {
+			IdempotencyWindow, err = time.ParseDuration(config.General.IdempotencyWindow)
+			if err != nil {
+				log.Fatalf("Bad IdempotencyWindow in config file: %s", err.Error())
+			}
+		}
 		if config.Mysql.Database != "" {
 			mysqlLocation = fmt.Sprintf("%s:%s@tcp(%s:%s)/%s",
 				config.Mysql.User,
@@ -166,27 +232,131 @@ func main() {
 				config.Mysql.Port,
 				config.Mysql.Database)
 		}
+		if config.Postgres.Database != "" {
+			u := url.URL{
+				Scheme: "postgres",
+				User:   url.UserPassword(config.Postgres.User, config.Postgres.Password),
+				Host:   config.Postgres.Host + ":" + config.Postgres.Port,
+				Path:   "/" + config.Postgres.Database,
+			}
+			if config.Postgres.SSLMode != "" {
+				u.RawQuery = url.Values{"sslmode": {config.Postgres.SSLMode}}.Encode()
+			}
+			pgLocation = u.String()
+		}
+	}
+
+	if raftPeers != "" {
+		var err error
+		raftConfig.Peers, err = ParseRaftPeers(raftPeers)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	sig := make(chan os.Signal, 5)
 	signal.Notify(sig)
 	go signalHandler(sig, logw)
 
+	switch flag.Arg(0) {
+	case "db":
+		// opening the store would upgrade the database
+		err := dbCommand(sqliteFile, mysqlLocation, pgLocation, flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "migrate":
+		// migrate opens and locks its own stores, and the configured
+		// store may be one of them
+		err := migrate(flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	store := openStore(storageDir, boltFile, sqliteFile, mysqlLocation, pgLocation, shared, raftConfig)
+	if !shared {
+		lockStore(store)
+	}
+	if flag.NArg() > 0 {
+		err := runCommand(store, flag.Args())
+		unlockStore()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	SetupHandlers(store)
+	if pidfilename != "" {
+		writePID(pidfilename)
+	}
+	log.Println("Listening on port", port)
+	err := http.ListenAndServe(":"+port, nil)
+	if err != nil {
+                // This should send errors from any of the HTTP routes to Sentry
+                sentry.CaptureException(err)
+		log.Fatal("ListenAndServe: ", err)
+	}
+	unlockStore()
+	if pidfilename != "" {
+		// we don't care if there is an error
+		os.Remove(pidfilename)
+	}
+}
+
+// openStore returns the PoolStore for the storage options given, or nil if
+// no storage was given. If shared is set, a database is opened so that
+// other servers may use it at the same time. If rc has a directory, the
+// server joins a raft cluster instead. If a database is given, openStore
+// keeps trying until it can connect.
+func openStore(storageDir, boltFile, sqliteFile, mysqlLocation, pgLocation string, shared bool, rc RaftConfig) PoolStore {
 	var (
 		store PoolStore
 		db    *sql.DB
 		err   error
 	)
+	newStore := NewDbFileStore
+	if shared {
+		newStore = NewSharedDbStore
+	}
+	migrations := dbMigrations
 	switch {
+	case rc.Dir != "":
+		log.Println("Pool storage is raft cluster", rc.ID, "in", rc.Dir)
+		store, err = NewRaftStore(rc)
+		if err != nil {
+			log.Fatalf("Error starting raft: %s", err.Error())
+		}
 	case storageDir != "":
+		if shared {
+			log.Fatal("A storage directory cannot be shared")
+		}
 		log.Println("Pool storage is directory", storageDir)
 		store = NewJsonFileStore(storageDir)
+	case boltFile != "":
+		if shared {
+			log.Fatal("A bolt file cannot be shared")
+		}
+		log.Println("Pool storage is bolt file", boltFile)
+		store, err = NewBoltStore(boltFile)
+		if err != nil {
+			log.Fatalf("Error opening bolt file: %s", err.Error())
+		}
 	case sqliteFile != "":
 		log.Println("Pool storage is sqlite3 database", sqliteFile)
 		db, err = sql.Open("sqlite3", sqliteFile)
 	case mysqlLocation != "":
 		log.Println("Pool storage is MySQL database", sanitizeDatabaseLocation(mysqlLocation))
 		db, err = sql.Open("mysql", mysqlLocation)
+	case pgLocation != "":
+		log.Println("Pool storage is PostgreSQL database", sanitizeDatabaseLocation(pgLocation))
+		db, err = sql.Open("postgres", pgLocation)
+		newStore = NewPostgresStore
+		if shared {
+			newStore = NewSharedPostgresStore
+		}
+		migrations = pgMigrations
 	}
 	if err != nil {
                 sentry.CaptureException(err)
@@ -194,8 +364,13 @@ func main() {
 	}
 	if db != nil {
 		var waitTime = 1
-		store = NewDbFileStore(db)
+		store = newStore(db)
 		for store == nil {
+			// retrying will not help if the database is newer than we are
+			_, err = upgradeSchema(db, migrations)
+			if errors.Is(err, SchemaTooNew) {
+				log.Fatalf("Error opening database: %s", err.Error())
+			}
 			log.Printf("Problem loading pools from database. Trying again in %d seconds", waitTime)
 			time.Sleep(time.Duration(waitTime) * time.Second)
 			waitTime *= 2
@@ -204,24 +379,19 @@ func main() {
 				waitTime = 300
 			}
 			// try again
-			store = NewDbFileStore(db)
+			store = newStore(db)
 		}
 	}
-	SetupHandlers(store)
-	if pidfilename != "" {
-		writePID(pidfilename)
-	}
-	log.Println("Listening on port", port)
-	err = http.ListenAndServe(":"+port, nil)
-	if err != nil {
-                // This should send errors from any of the HTTP routes to Sentry
-                sentry.CaptureException(err)
-		log.Fatal("ListenAndServe: ", err)
-	}
-	if pidfilename != "" {
-		// we don't care if there is an error
-		os.Remove(pidfilename)
+	return store
+}
+
+// runCommand runs the subcommand given on the command line instead of the server.
+func runCommand(store PoolStore, args []string) error {
+	switch args[0] {
+	case "import-rails":
+		return importRails(store, args[1:])
 	}
+	return fmt.Errorf("Unknown command %q", args[0])
 }
 
 func sanitizeDatabaseLocation(location string) string {
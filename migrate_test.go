@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	src := NewJsonFileStore(dir)
+	src.SavePool("a", PoolInfo{Name: "a", Template: ".sd+3", Owner: "library"})
+	src.SavePool("b", PoolInfo{Name: "b", Template: ".sd+5"})
+	src.DeletePool("c", Tombstone{Name: "c", Template: ".sd+1", Deleted: time.Now().Round(time.Second)})
+
+	fname := filepath.Join(t.TempDir(), "noids.sqlite")
+	args := []string{"-from", "dir:" + dir, "-to", "sqlite:" + fname}
+	err := migrate(append([]string{"-dry-run"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, closer, err := openStoreSpec("sqlite:"+fname, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	pis, err := dst.LoadAllPools()
+	if err != nil || len(pis) != 0 {
+		t.Fatalf("Got %v, %v", pis, err)
+	}
+
+	err = migrate(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pis, err = dst.LoadAllPools()
+	if err != nil || len(pis) != 2 {
+		t.Fatalf("Got %v, %v", pis, err)
+	}
+	tombs, err := dst.LoadAllTombstones()
+	if err != nil || len(tombs) != 1 || tombs[0].Name != "c" {
+		t.Errorf("Got %v, %v", tombs, err)
+	}
+
+	// the destination has moved on, so it is not overwritten
+	dst.SavePool("b", PoolInfo{Name: "b", Template: ".sd+9"})
+	src.SavePool("a", PoolInfo{Name: "a", Template: ".sd+4", Owner: "library"})
+	plan, err := planMigration(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 3 || plan[0].action != "update" || !plan[1].refused || plan[2].action != "tombstone unchanged" {
+		t.Fatalf("Got %v", plan)
+	}
+	if len(plan[0].diff) != 1 || plan[0].diff[0] != `Template: ".sd+3" -> ".sd+4"` {
+		t.Errorf("Got %v", plan[0].diff)
+	}
+	err = migrate(args)
+	if err == nil {
+		t.Errorf("Expected an error")
+	}
+	pis, err = dst.LoadAllPools()
+	for _, pi := range pis {
+		if pi.Name == "a" && pi.Template != ".sd+3" {
+			t.Errorf("Got %v", pi)
+		}
+	}
+}
+
+func TestMigrateDryRunReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	src := NewJsonFileStore(dir)
+	src.SavePool("a", PoolInfo{Name: "a", Template: ".sd+3"})
+	// a corrupt file, and a pool in a file with the old name
+	os.WriteFile(filepath.Join(dir, "bad.json"), []byte("{"), 0666)
+	data, _ := encodeChecked(PoolInfo{Name: "b.c", Template: ".sd+1"})
+	os.WriteFile(filepath.Join(dir, "b.c"), data, 0666)
+	before := listDir(t, dir)
+
+	fname := filepath.Join(t.TempDir(), "noids.sqlite")
+	err := migrate([]string{"-dry-run", "-from", "dir:" + dir, "-to", "sqlite:" + fname})
+	if err == nil {
+		t.Errorf("Expected an error for the corrupt file")
+	}
+	after := listDir(t, dir)
+	if strings.Join(before, ",") != strings.Join(after, ",") {
+		t.Errorf("Directory changed from %v to %v", before, after)
+	}
+}
+
+// listDir lists the files in dir
+func listDir(t *testing.T, dir string) []string {
+	var names []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil {
+			names = append(names, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestMigrateTemplateChanged(t *testing.T) {
+	src := NewJsonFileStore(t.TempDir())
+	dst := NewJsonFileStore(t.TempDir())
+	src.SavePool("a", PoolInfo{Name: "a", Template: ".sdd+50"})
+	dst.SavePool("a", PoolInfo{Name: "a", Template: ".sd+3"})
+	// the destination has not minted anything yet
+	src.SavePool("k", PoolInfo{Name: "k", Template: ".udd+1", Key: []byte("secret one")})
+	dst.SavePool("k", PoolInfo{Name: "k", Template: ".udd+0", Key: []byte("secret two")})
+	// but here it has, with another key
+	src.SavePool("m", PoolInfo{Name: "m", Template: ".udd+5", Key: []byte("secret one")})
+	dst.SavePool("m", PoolInfo{Name: "m", Template: ".udd+2", Key: []byte("secret two")})
+	// or another prefix
+	src.SavePool("n", PoolInfo{Name: "n", Template: ".sd+5", NAAN: "13030", Shoulder: "xf"})
+	dst.SavePool("n", PoolInfo{Name: "n", Template: ".sd+2", NAAN: "13030", Shoulder: "xg"})
+	plan, err := planMigration(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 4 || !plan[0].refused || plan[1].action != "update" || !plan[2].refused || !plan[3].refused {
+		t.Fatalf("Got %v", plan)
+	}
+	if strings.Join(plan[1].diff, "\n") != "Key: changed\nTemplate: \".udd+0\" -> \".udd+1\"" {
+		t.Errorf("Got %v", plan[1].diff)
+	}
+}
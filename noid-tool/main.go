@@ -9,22 +9,27 @@
 //
 // Options:
 //  -i      print information about the given templates
+//  -naan   mint and validate ARKs having the given NAAN
+//  -shoulder   the ARK shoulder to use with -naan
+//  -key    the hex encoded key for templates using the 'u' generator
 //  -h      print this help text and exit
 //
 // When the -i option is given, noid-tool will display information about the
 // given templates to stdout. Otherwise noid-tool will output the sequence
 // number of each noid with respect to the given template. Invalid noids
-// will have a sequence number of -1. If no noids are given on the command
+// will have a sequence number of -1 and the reason they are invalid.
+// If no noids are given on the command
 // line, noid-tool will take them from stdin, with each noid on its
 // own line.
 package main
 
 import (
 	"bufio"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"math/big"
 	"os"
-	"strconv"
 
 	"github.com/ndlib/noids/noid"
 )
@@ -39,28 +44,43 @@ usage:
 noid-tool info [<template list>]
 noid-tool valid <template> [<noid list>]
 noid-tool generate <template> [<number list>]
+noid-tool perl-import -name <pool> (-o <file or directory> | -server <url>) <dump file>
 
 Options:
- -h      print this help text and exit
+ -naan <naan>          mint and validate ARKs having the given NAAN
+ -shoulder <shoulder>  the ARK shoulder to use with -naan
+ -key <hex>            the key for templates using the 'u' generator
+ -h                    print this help text and exit
 
 'info'
     Display information about the given templates to stdout.
 
 'valid'
     Output the sequence number of each id with respect to the given template.
-    Invalid ids will have a sequence number of -1.
+    Invalid ids will have a sequence number of -1, followed by the reason
+    the id is invalid.
 
 'generate'
     Output the ids associated to each given sequence number.
 
+'perl-import'
+    Make a pool equivalent to a Perl NOID minter, given a text dump of its
+    NOID/noid.bdb database made with 'db_dump -p'. The pool information is
+    either written as a JSON file (-o), which may be copied into the noids
+    storage directory, or the pool is created on a noids server (-server).
+    Held and queued ids which the new pool cannot represent are listed on
+    stderr.
+
 
 If no ids are given on the command line, they will be taken from stdin,
 with each id on its own line.`)
 }
 
+var arkOptions noid.Options
+
 func getNoid(template string) *noid.Noid {
 	var n noid.Noid
-	n, err := noid.NewNoid(template)
+	n, err := noid.NewNoidOptions(template, arkOptions)
 	if err != nil {
 		fmt.Printf("%s\tInvalid Template: %s\n", template, err.Error())
 		return nil
@@ -75,24 +95,31 @@ func printTemplateInfo(t string) {
 	}
 	pos, max := (*n).Count()
 	var used float64 = 0
-	if max != -1 {
-		used = (float64(pos) / float64(max)) * 100
+	if max.Sign() > 0 {
+		used, _ = new(big.Rat).SetFrac(pos, max).Float64()
+		used *= 100
 	}
 	fmt.Printf("%s\tValid, Pos = %d, Max = %d, %0.2f%% used\n", t, pos, max, used)
 }
 
 func validateId(n *noid.Noid, id string) {
-	var idx int = (*n).Index(id)
+	idx, err := (*n).Validate(id)
+	if err != nil {
+		var reason = err.Error()
+		if e, ok := err.(*noid.IdError); ok {
+			reason = e.Reason()
+		}
+		fmt.Printf("-1\t%s\t%s\n", id, reason)
+		return
+	}
 	fmt.Printf("%d\t%s\n", idx, id)
 }
 
 func generate(n *noid.Noid, index string) {
-	var i int
 	var result string
-	var err error
-	if i, err = strconv.Atoi(index); err == nil {
+	if i, ok := new(big.Int).SetString(index, 10); ok && i.Sign() >= 0 {
 		_, max := (*n).Count()
-		if max == -1 || i < max {
+		if max.Sign() < 0 || i.Cmp(max) < 0 {
 			(*n).AdvanceTo(i)
 			result = (*n).Mint()
 		}
@@ -101,8 +128,22 @@ func generate(n *noid.Noid, index string) {
 }
 
 func main() {
+	var key string
+
 	flag.Usage = usage
+	flag.StringVar(&arkOptions.NAAN, "naan", "", "NAAN for ARKs")
+	flag.StringVar(&arkOptions.Shoulder, "shoulder", "", "shoulder for ARKs")
+	flag.StringVar(&key, "key", "", "hex encoded key for 'u' templates")
 	flag.Parse()
+
+	if key != "" {
+		var err error
+		arkOptions.Key, err = hex.DecodeString(key)
+		if err != nil {
+			fmt.Println("Invalid key:", err.Error())
+			return
+		}
+	}
 	args := flag.Args()
 
 	if len(args) == 0 {
@@ -115,6 +156,13 @@ func main() {
 	var f func(string)
 	var rest []string
 	switch args[0] {
+	case "perl-import":
+		err := perlImport(args[1:])
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		return
 	case "info":
 		f = printTemplateInfo
 		rest = args[1:]
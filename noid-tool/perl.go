@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ndlib/noids/noid"
+)
+
+// poolInfo has the same fields as the pool information saved by the noids
+// server. It is written as a JSON file which may be copied into the
+// server's storage directory.
+type poolInfo struct {
+	Name, Template string
+	Closed         bool
+	LastMint       time.Time
+	NAAN           string `json:",omitempty"`
+}
+
+// poolFileName returns the name the server gives the file of the pool
+// `name` in its storage directory: the name percent-encoded, except for
+// letters, digits, "-" and "_", followed by ".json".
+func poolFileName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String() + ".json"
+}
+
+// perlDump holds the keys and values of a Perl NOID database
+type perlDump map[string]string
+
+// readPerlDump reads the output of db_dump on a NOID/noid.bdb file. Both the
+// printable (db_dump -p) and the hexadecimal formats are understood.
+func readPerlDump(r io.Reader) (perlDump, error) {
+	var (
+		result   = make(perlDump)
+		inHeader = true
+		printFmt = false
+		key      string
+		haveKey  = false
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inHeader {
+			switch {
+			case line == "format=print":
+				printFmt = true
+			case line == "HEADER=END":
+				inHeader = false
+			}
+			continue
+		}
+		if line == "DATA=END" {
+			break
+		}
+		if !strings.HasPrefix(line, " ") {
+			return nil, fmt.Errorf("Unexpected line in dump: %q", line)
+		}
+		var v string
+		var err error
+		if printFmt {
+			v, err = unescapePrint(line[1:])
+		} else {
+			var b []byte
+			b, err = hex.DecodeString(line[1:])
+			v = string(b)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if haveKey {
+			result[key] = v
+		} else {
+			key = v
+		}
+		haveKey = !haveKey
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if inHeader {
+		return nil, errors.New("Dump has no HEADER=END line")
+	}
+	return result, nil
+}
+
+// unescapePrint decodes a line of db_dump -p output, in which a backslash is
+// written as \\ and non-printing bytes as a backslash followed by two hex digits.
+func unescapePrint(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '\\' {
+			b.WriteByte('\\')
+			i++
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("Bad escape in %q", s)
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("Bad escape in %q", s)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// perlMinter is the part of a Perl NOID database we use
+type perlMinter struct {
+	Template string // noids template, without a position
+	NAAN     string
+	Position *big.Int
+	Held     []string
+	Queued   []string
+}
+
+func newPerlMinter(d perlDump) (perlMinter, error) {
+	var m perlMinter
+
+	mask := d[":/mask"]
+	if mask == "" {
+		return m, errors.New("Dump is not a NOID database: there is no :/mask key")
+	}
+	m.Template = d[":/prefix"] + "." + mask
+	m.NAAN = d[":/naan"]
+
+	seq, err := perlNumber(d, ":/oacounter")
+	if err != nil {
+		return m, err
+	}
+	// The Perl counters are numbered c0, c1, ..., and their values are
+	// offsets into the counter. Exhausted counters are moved from the
+	// saclist to the siclist.
+	var counters []noid.Counter
+	if sac := strings.Fields(d[":/saclist"]); len(sac) > 0 {
+		percounter, err := perlNumber(d, ":/percounter")
+		if err != nil {
+			return m, err
+		}
+		for _, name := range sac {
+			n, ok := new(big.Int).SetString(strings.TrimPrefix(name, "c"), 10)
+			if !ok {
+				return m, fmt.Errorf("Bad counter name %q", name)
+			}
+			value, err := perlNumber(d, ":/"+name+"/value")
+			if err != nil {
+				return m, err
+			}
+			top, err := perlNumber(d, ":/"+name+"/top")
+			if err != nil {
+				return m, err
+			}
+			start := n.Mul(n, percounter)
+			counters = append(counters, noid.Counter{
+				Value: value.Add(value, start),
+				Max:   top.Add(top, start),
+			})
+		}
+	}
+	m.Position, err = noid.LegacyPosition(m.Template, seq, counters)
+	if err != nil {
+		return m, err
+	}
+
+	// held ids have a key "<id>\t:/h". Queued ids are the values of the
+	// keys ":/q/<date>/<seqnum>/<padded id>".
+	for k, v := range d {
+		switch {
+		case strings.HasSuffix(k, "\t:/h") && v != "" && v != "0":
+			m.Held = append(m.Held, strings.TrimSuffix(k, "\t:/h"))
+		case strings.HasPrefix(k, ":/q/"):
+			m.Queued = append(m.Queued, v)
+		}
+	}
+	sort.Strings(m.Held)
+	sort.Strings(m.Queued)
+	return m, nil
+}
+
+func perlNumber(d perlDump, key string) (*big.Int, error) {
+	v := d[key]
+	if v == "" {
+		return new(big.Int), nil
+	}
+	n, ok := new(big.Int).SetString(v, 10)
+	if !ok {
+		return nil, fmt.Errorf("Key %s has the value %q, which is not a number", key, v)
+	}
+	return n, nil
+}
+
+// problems returns a list of the held and queued ids which the pool for m
+// cannot represent. Held ids at or past the pool's position may be minted
+// by the pool. The pool has no queue, so queued ids will never be minted.
+func (m perlMinter) problems() ([]string, error) {
+	var result []string
+	n, err := noid.NewNoidOptions(m.Template, noid.Options{NAAN: m.NAAN})
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range m.Held {
+		index, err := n.Validate(id)
+		switch {
+		case err != nil:
+			result = append(result, fmt.Sprintf("held\t%s\tinvalid: %s", id, err.(*noid.IdError).Reason()))
+		case index.Cmp(m.Position) >= 0:
+			result = append(result, fmt.Sprintf("held\t%s\tmay be minted by the pool, index %v", id, index))
+		}
+	}
+	for _, id := range m.Queued {
+		result = append(result, fmt.Sprintf("queued\t%s\tthe pool will not mint queued ids", id))
+	}
+	return result, nil
+}
+
+// perlImport implements the perl-import subcommand
+func perlImport(args []string) error {
+	var name, output, server string
+
+	fs := flag.NewFlagSet("perl-import", flag.ExitOnError)
+	fs.StringVar(&name, "name", "", "name of the pool to make")
+	fs.StringVar(&output, "o", "", "write the pool information to this file, or to the pool's file in this directory")
+	fs.StringVar(&server, "server", "", "create the pool on the noids server at this URL")
+	fs.Parse(args)
+	if fs.NArg() != 1 || name == "" || (output == "") == (server == "") {
+		return errors.New("usage: noid-tool perl-import -name <pool> (-o <file or directory> | -server <url>) <dump file>")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d, err := readPerlDump(f)
+	if err != nil {
+		return err
+	}
+	m, err := newPerlMinter(d)
+	if err != nil {
+		return err
+	}
+	problems, err := m.problems()
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, p)
+	}
+
+	pi := poolInfo{
+		Name:     name,
+		Template: m.Template + "+" + m.Position.String(),
+		LastMint: time.Now(),
+		NAAN:     m.NAAN,
+	}
+	if output != "" {
+		if fi, err := os.Stat(output); err == nil && fi.IsDir() {
+			output = filepath.Join(output, poolFileName(name))
+		}
+		out, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		err = json.NewEncoder(out).Encode(pi)
+		if err2 := out.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%s\twritten to %s\n", pi.Name, pi.Template, output)
+		return nil
+	}
+
+	form := url.Values{"name": {pi.Name}, "template": {pi.Template}}
+	if pi.NAAN != "" {
+		form.Set("naan", pi.NAAN)
+	}
+	resp, err := http.PostForm(strings.TrimSuffix(server, "/")+"/pools", form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 201 {
+		return fmt.Errorf("Server returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Printf("%s\t%s\tcreated\n", pi.Name, pi.Template)
+	return nil
+}
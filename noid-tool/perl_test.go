@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// part of a db_dump -p of a Perl NOID database made with
+// `noid dbcreate tf.sddk long 13030 cdlib.org oac/cmp`, after minting 12 ids,
+// holding two, and queueing one.
+const perlSequentialDump = `VERSION=3
+format=print
+type=btree
+db_pagesize=8192
+HEADER=END
+ :/generator_type
+ sequential
+ :/mask
+ sddk
+ :/naan
+ 13030
+ :/oacounter
+ 12
+ :/prefix
+ tf
+ :/template
+ tf.sddk
+ 13030/tf05r\09:/h
+ 1
+ 13030/tf95j\09:/h
+ 1
+ :/q/20131203101112/000001/tf032
+ 13030/tf032
+DATA=END
+`
+
+func TestPerlSequential(t *testing.T) {
+	d, err := readPerlDump(strings.NewReader(perlSequentialDump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d[":/template"] != "tf.sddk" || d["13030/tf05r\t:/h"] != "1" {
+		t.Fatalf("Got %v\n", d)
+	}
+	m, err := newPerlMinter(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Template != "tf.sddk" || m.NAAN != "13030" || m.Position.Int64() != 12 {
+		t.Errorf("Got %v\n", m)
+	}
+	problems, err := m.problems()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tf05r is id 5, which was minted already. tf95j is id 95.
+	expected := []string{
+		"held\t13030/tf95j\tmay be minted by the pool, index 95",
+		"queued\t13030/tf032\tthe pool will not mint queued ids",
+	}
+	if strings.Join(problems, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Got %q\n", problems)
+	}
+}
+
+// a random minter for .rdd has 100 counters of 1 id each. Here c0, c1,
+// and c2 have been used. Since c0 is the first id in our sequence, c1 the
+// second, and so on, the pool should start at 3.
+func TestPerlRandom(t *testing.T) {
+	var dump = []string{"VERSION=3", "format=print", "HEADER=END",
+		" :/mask", " rdd",
+		" :/oacounter", " 3",
+		" :/percounter", " 1",
+	}
+	var sac []string
+	for i := 3; i < 100; i++ {
+		sac = append(sac, fmt.Sprintf("c%d", i))
+		dump = append(dump,
+			fmt.Sprintf(" :/c%d/value", i), " 0",
+			fmt.Sprintf(" :/c%d/top", i), " 1")
+	}
+	dump = append(dump, " :/saclist", " "+strings.Join(sac, " "), "DATA=END")
+
+	d, err := readPerlDump(strings.NewReader(strings.Join(dump, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newPerlMinter(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Template != ".rdd" || m.Position.Int64() != 3 {
+		t.Errorf("Got %v, %v\n", m.Template, m.Position)
+	}
+}
+
+// the dump without -p has the keys and values in hex
+const perlHexDump = `VERSION=3
+format=bytevalue
+type=btree
+HEADER=END
+ 3a2f6d61736b
+ 726464
+ 3a2f6f61636f756e746572
+ 33
+DATA=END
+`
+
+func TestPerlHexDump(t *testing.T) {
+	d, err := readPerlDump(strings.NewReader(perlHexDump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d) != 2 || d[":/mask"] != "rdd" || d[":/oacounter"] != "3" {
+		t.Errorf("Got %v\n", d)
+	}
+}
+
+func TestPerlImportDir(t *testing.T) {
+	dir := t.TempDir()
+	dump := filepath.Join(dir, "noid.dump")
+	os.WriteFile(dump, []byte(perlSequentialDump), 0666)
+	storage := filepath.Join(dir, "pools")
+	os.Mkdir(storage, 0777)
+
+	// given a directory, the file is named as the server names it
+	err := perlImport([]string{"-name", "oac.cmp", "-o", storage, dump})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(storage, "oac%2Ecmp.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"Template":"tf.sddk+12"`) {
+		t.Errorf("Got %s", data)
+	}
+}
@@ -0,0 +1,93 @@
+package noid
+
+import (
+	"errors"
+	"math/big"
+)
+
+var (
+	CounterError = errors.New("Counter does not match the template")
+)
+
+// Counter is the state of one of the bins (which they call "counters") used
+// by the Perl NOID minter and the ruby noid gem to choose random ids.
+// Each counter hands out the numbers in a range in sequence. Value is the
+// next number the counter will hand out and Max is one more than the last
+// number the counter will hand out. Both are absolute positions in the id
+// space, not offsets into the counter.
+type Counter struct {
+	Value, Max *big.Int
+}
+
+// LegacyPosition returns the position a minter having the given template
+// needs to be advanced to so that it will never mint an id which a legacy
+// (Perl or ruby) minter has minted. seq is the number of ids the legacy
+// minter has minted. For random templates, counters is the state of the
+// legacy minter's counters. Both legacy minters drop a counter once it
+// is exhausted, so every range not having a counter in the list is taken to
+// be completely used.
+//
+// Since the legacy minters choose between their counters at random and we
+// interleave the counters in sequence, the position returned for random
+// templates is usually larger than seq. The ids between seq and the
+// position are lost.
+func LegacyPosition(template string, seq *big.Int, counters []Counter) (*big.Int, error) {
+	n, err := NewNoid(template)
+	if err != nil {
+		return nil, err
+	}
+	ns := n.(*noidState)
+	if seq.Sign() < 0 || (ns.max.Sign() >= 0 && seq.Cmp(ns.max) > 0) {
+		return nil, PositionError
+	}
+	if ns.generator != 'r' || seq.Sign() == 0 {
+		return new(big.Int).Set(seq), nil
+	}
+
+	// find how much of each of our bins the legacy minter has used
+	rs := ns.r
+	nBins := int(rs.nBins.Int64())
+	used := make([]*big.Int, nBins)
+	for _, c := range counters {
+		var bin, start big.Int
+		if c.Max.Sign() <= 0 || c.Max.Cmp(ns.max) > 0 {
+			return nil, CounterError
+		}
+		bin.Sub(c.Max, bigOne)
+		bin.Quo(&bin, rs.binSize)
+		start.Mul(&bin, rs.binSize)
+		if c.Value.Cmp(&start) < 0 || c.Value.Cmp(c.Max) > 0 {
+			return nil, CounterError
+		}
+		// be safe if two counters claim the same bin
+		if u := used[bin.Int64()]; u == nil || u.Cmp(c.Value) < 0 {
+			used[bin.Int64()] = c.Value
+		}
+	}
+
+	// The position is one past the largest index of the last number
+	// used in each bin
+	var result = new(big.Int).Set(seq)
+	for i := 0; i < nBins; i++ {
+		var start, end big.Int
+		start.Mul(big.NewInt(int64(i)), rs.binSize)
+		if used[i] != nil {
+			end.Set(used[i])
+		} else {
+			end.Add(&start, rs.binSize)
+			if end.Cmp(ns.max) > 0 {
+				end.Set(ns.max)
+			}
+		}
+		if end.Cmp(&start) <= 0 {
+			continue
+		}
+		end.Sub(&end, bigOne)
+		position := rs.invSwizzle(&end)
+		position.Add(position, bigOne)
+		if position.Cmp(result) > 0 {
+			result = position
+		}
+	}
+	return result, nil
+}
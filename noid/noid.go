@@ -12,13 +12,18 @@ The noid template string has the following format:
 
 Where
 	<slug> is any sequence of characters (may be empty).
-	<generator> is one of 'r', 'c', 'z'
+	<generator> is one of 'r', 's', 'z', 'u'
 	<bins?> is an optional sequence of decimal digits
 	<digits> is a sequence of 'd' and 'e' characters
 	<check?> is an optional 'k' character
 
 The <bins> element is optional, but can only be present if the generator is 'r'
 
+The 'u' generator ("unguessable") is not part of the NOID specification. It
+scatters ids through the idspace like 'r', but the order is determined by a
+secret key which is given to the minter separately from the template. Without
+the key the sequence of ids cannot be predicted.
+
 Example format strings:
 
 	id.sd
@@ -33,26 +38,80 @@ a noid minter as a string. The format is
 	<noid template> '+' <number ids minted>
 
 <id count> is a decimal integer >= 0. it is taken to be 0 if omitted.
+It may not be larger than the number of ids the template can produce.
 
 For example:
 	.zddddk+389
 	.reeddeeddek+54321
 
+Counters are arbitrary precision, so there is no limit on the size of the
+id space a template may describe.
+
+A minter may also be given a NAAN and a shoulder, in which case it mints ARKs
+of the form
+
+	ark:/<NAAN>/<shoulder><slug><digits><check?>
+
+and the check character is computed over "<NAAN>/<shoulder><slug><digits>",
+as described in the NOID specification. The NAAN and shoulder are not part of
+the template string.
+
 */
 package noid
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"math/big"
 	"regexp"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 var (
 	TemplateError = errors.New("Bad Template String")
+	PositionError = errors.New("Template position is larger than the template maximum")
+	ArkError      = errors.New("Bad NAAN or shoulder")
+	KeyError      = errors.New("Template requires a key")
+
+	// The reasons an id may be invalid for a noid. Validate returns
+	// these wrapped inside an *IdError, so use errors.Is() to test for them.
+	SlugError      = errors.New("wrong slug or prefix")
+	CheckError     = errors.New("check character does not match")
+	CharacterError = errors.New("bad character")
+	ShortError     = errors.New("too short")
+	LongError      = errors.New("too long")
+	RangeError     = errors.New("beyond the pool maximum")
 )
 
+// An IdError describes why an id is not valid for a noid.
+type IdError struct {
+	Id       string
+	Err      error // one of SlugError, CheckError, CharacterError, etc.
+	Position int   // position of the bad character, counting from 1, if Err is CharacterError
+}
+
+// Reason describes the problem with the id without repeating the id.
+func (e *IdError) Reason() string {
+	if e.Err == CharacterError {
+		c, _ := utf8.DecodeRuneInString(e.Id[e.Position-1:])
+		return fmt.Sprintf("%s %q at position %d", e.Err, c, e.Position)
+	}
+	return e.Err.Error()
+}
+
+func (e *IdError) Error() string {
+	return fmt.Sprintf("id %q: %s", e.Id, e.Reason())
+}
+
+func (e *IdError) Unwrap() error {
+	return e.Err
+}
+
 const (
 	XDigit          = "0123456789bcdfghjkmnpqrstvwxz"
 	defaultBinCount = 293
@@ -65,31 +124,84 @@ type Noid interface {
 	// returns the template used to create this noid generator
 	String() string
 	// returns the number of noids minted and the maximum number possible
-	Count() (int, int)
+	Count() (*big.Int, *big.Int)
 	// return the id's sequence number (0 = first id minted, 1 = second id
 	// minted, etc) or -1 if the id is invalid for this noid.
 	// n.b. The sequence number may be higher than the number of noids
 	// minted so far
-	Index(id string) int
+	Index(id string) *big.Int
+	// return the id's sequence number, or an *IdError explaining why
+	// the id is invalid for this noid.
+	Validate(id string) (*big.Int, error)
 	// move the minter counter to n, may be any integer between 0 and this noid's MAX
 	// setting the index to == MAX will have the effect of exhausting the noid
 	// indexes outside that range are silently ignored
-	AdvanceTo(n int)
+	AdvanceTo(n *big.Int)
+}
+
+var bigOne = big.NewInt(1)
+
+// Options holds the settings for a noid minter which are not part of
+// its template.
+type Options struct {
+	// If NAAN is set, the minter mints ARKs of the form
+	// ark:/<NAAN>/<Shoulder><id>. Both are betanumeric strings, and
+	// Shoulder may be empty. Shoulder may only be given with a NAAN.
+	NAAN, Shoulder string
+
+	// Key is the secret used by the 'u' generator. It is required for
+	// templates using that generator, and ignored otherwise.
+	Key []byte
+}
+
+// NeedsKey returns true if the template uses a generator which requires
+// a key.
+func NeedsKey(template string) bool {
+	t, ok := parseTemplate(template)
+	return ok && t.generator == 'u'
 }
 
+// NewKey returns a random key suitable for use with the 'u' generator.
+func NewKey() ([]byte, error) {
+	key := make([]byte, keySize)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+var (
+	betanumericRegexp = regexp.MustCompile(`^[0-9bcdfghjkmnpqrstvwxz]*$`)
+)
+
 // Create a new noid minter having the specified template.
+// A PositionError is returned if the template's position is past the
+// end of the template's id space.
 func NewNoid(template string) (Noid, error) {
-	result := &noidState{}
+	return NewNoidOptions(template, Options{})
+}
+
+// Create a new noid minter having the specified template and options.
+func NewNoidOptions(template string, opts Options) (Noid, error) {
+	result := &noidState{position: new(big.Int)}
 	t, ok := parseTemplate(template)
 	if !ok {
 		return result, TemplateError
 	}
+	if !betanumericRegexp.MatchString(opts.NAAN) ||
+		!betanumericRegexp.MatchString(opts.Shoulder) ||
+		(opts.NAAN == "" && opts.Shoulder != "") {
+		return result, ArkError
+	}
 
 	result.template = t
+	result.naan = opts.NAAN
+	result.shoulder = opts.Shoulder
 	result.sizes = generateSizes(t.template)
 	result.max = result.maximum()
-	if result.max == -1 || (result.pos <= result.max) {
-		result.position = result.pos
+	if t.pos != nil {
+		if result.max.Sign() >= 0 && t.pos.Cmp(result.max) > 0 {
+			return result, PositionError
+		}
+		result.position.Set(t.pos)
 	}
 	if result.generator == 'r' {
 		var bincount int = defaultBinCount
@@ -98,6 +210,12 @@ func NewNoid(template string) (Noid, error) {
 		}
 		result.r = newRandomState(bincount, result.max)
 	}
+	if result.generator == 'u' {
+		if len(opts.Key) == 0 {
+			return result, KeyError
+		}
+		result.f = newFeistelState(opts.Key, result.max)
+	}
 	return result, nil
 }
 
@@ -116,27 +234,30 @@ func generateSizes(t string) []int {
 	return result
 }
 
-func (ns noidState) maximum() int {
+func (ns noidState) maximum() *big.Int {
 	if ns.generator == 'z' {
-		return -1
+		return big.NewInt(-1)
 	}
-	var result int = 1
+	var result = big.NewInt(1)
 	for _, v := range ns.sizes {
-		result *= v
+		result.Mul(result, big.NewInt(int64(v)))
 	}
 	return result
 }
 
 // Mint a single identifier using the given noid.
 func (ns *noidState) Mint() string {
-	if ns.max >= 0 && ns.position >= ns.max {
+	if ns.max.Sign() >= 0 && ns.position.Cmp(ns.max) >= 0 {
 		// pool exhausted
 		return ""
 	}
-	var id int = ns.position
-	ns.position++
-	if ns.generator == 'r' {
+	var id = new(big.Int).Set(ns.position)
+	ns.position.Add(ns.position, bigOne)
+	switch ns.generator {
+	case 'r':
 		id = ns.r.swizzle(id)
+	case 'u':
+		id = ns.f.encrypt(id)
 	}
 	return ns.mint(id)
 }
@@ -144,85 +265,156 @@ func (ns *noidState) Mint() string {
 // Count returns the number of ids minted so far
 // and the maximum number of ids in the pool
 // (the maximum is -1 if the pool is infinite)
-func (ns *noidState) Count() (int, int) {
-	return ns.position, ns.max
+func (ns *noidState) Count() (*big.Int, *big.Int) {
+	return new(big.Int).Set(ns.position), new(big.Int).Set(ns.max)
 }
 
 // String returns the noid state as an "extended" template,
 // i.e. the template string followed by the current position
 func (ns *noidState) String() string {
-	return ns.template.String() + fmt.Sprintf("+%d", ns.position)
+	return ns.template.String() + "+" + ns.position.String()
 }
 
 // Index converts a given identifier to its sequence number.
 // If the identifier is not valid, -1 is returned.
-func (ns *noidState) Index(id string) int {
-	v := ns.valid(id)
-	if v != -1 && ns.generator == 'r' {
-		v = ns.r.invSwizzle(v)
+func (ns *noidState) Index(id string) *big.Int {
+	v, err := ns.Validate(id)
+	if err != nil {
+		return big.NewInt(-1)
 	}
 	return v
 }
 
+// Validate converts a given identifier to its sequence number.
+// If the identifier is not valid, an *IdError is returned.
+func (ns *noidState) Validate(id string) (*big.Int, error) {
+	v, err := ns.valid(id)
+	if err == nil {
+		switch ns.generator {
+		case 'r':
+			v = ns.r.invSwizzle(v)
+		case 'u':
+			v = ns.f.decrypt(v)
+		}
+	}
+	return v, err
+}
+
 // AdvanceTo moves the current position to the position given.
 // The following code indicates the relationship between AdvanceTo, Mint, and Index:
-//	noid.AdvanceTo(5)
+//	noid.AdvanceTo(big.NewInt(5))
 //	id := noid.Mint()
 //	noid.Index(id) == 5
-func (ns *noidState) AdvanceTo(n int) {
-	if n < 0 || (ns.max >= 0 && n > ns.max) {
+func (ns *noidState) AdvanceTo(n *big.Int) {
+	if n.Sign() < 0 || (ns.max.Sign() >= 0 && n.Cmp(ns.max) > 0) {
 		// out of range. silently ignore
 		return
 	}
-	ns.position = n
+	ns.position.Set(n)
 }
 
 type noidState struct {
 	template
-	position int
-	max      int
-	sizes    []int        // the base of the i-th digit from the right
-	r        *randomState // non-nil iff generator == 'r'
+	position *big.Int
+	max      *big.Int      // -1 if the id space is infinite
+	sizes    []int         // the base of the i-th digit from the right
+	r        *randomState  // non-nil iff generator == 'r'
+	f        *feistelState // non-nil iff generator == 'u'
+	naan     string        // non-empty iff minting ARKs
+	shoulder string
 }
 
-func (ns noidState) mint(n int) string {
-	s := ns.slug + ns.iton(n)
+func (ns noidState) mint(n *big.Int) string {
+	s := ns.prefix() + ns.iton(n)
 	if ns.checkDigit {
 		s += checksum(s)
 	}
+	if ns.naan != "" {
+		s = "ark:/" + s
+	}
 	return s
 }
 
-// returns the id's index position, or -1 if invalid
-func (ns noidState) valid(id string) int {
+// prefix returns the part of an id which comes before the digits and
+// which is covered by the check character.
+func (ns noidState) prefix() string {
+	if ns.naan == "" {
+		return ns.slug
+	}
+	return ns.naan + "/" + ns.shoulder + ns.slug
+}
+
+// digitsStart returns the offset into id where the digits begin.
+// ARKs may be given as ark:/NAAN/id, ark:NAAN/id, NAAN/id, or as the bare id,
+// where the id begins with the shoulder and slug.
+func (ns noidState) digitsStart(id string) (int, bool) {
+	if ns.naan == "" {
+		return len(ns.slug), strings.HasPrefix(id, ns.slug)
+	}
+	var start int
+	var isArk = strings.HasPrefix(id, "ark:")
+	if isArk {
+		start = len("ark:")
+		if strings.HasPrefix(id[start:], "/") {
+			start++
+		}
+	}
+	if strings.HasPrefix(id[start:], ns.naan+"/") {
+		start += len(ns.naan) + 1
+	} else if isArk {
+		return 0, false
+	}
+	prefix := ns.shoulder + ns.slug
+	return start + len(prefix), strings.HasPrefix(id[start:], prefix)
+}
+
+// returns the id's index position, or an error if invalid
+func (ns noidState) valid(id string) (*big.Int, error) {
 	// does slug prefix match?
-	if !strings.HasPrefix(id, ns.slug) {
-		return -1
+	start, ok := ns.digitsStart(id)
+	if !ok {
+		return nil, &IdError{Id: id, Err: SlugError}
 	}
-	// does the checksum match?
-	if ns.checkDigit && checksum(id[:len(id)-1]) != id[len(id)-1:len(id)] {
-		return -1
+	digits := id[start:]
+	// ARKs may have qualifiers following the id, e.g. /page1 or .pdf
+	if ns.naan != "" {
+		if i := strings.IndexAny(digits, "/."); i >= 0 {
+			digits = digits[:i]
+		}
 	}
+	end := start + len(digits)
 	// are the digits the correct length?
-	digits := id[len(ns.slug):]
+	length := len(ns.sizes)
 	if ns.checkDigit {
-		digits = digits[:len(digits)-1]
+		length++
 	}
-	if len(digits) < len(ns.sizes) {
-		return -1
+	if len(digits) < length {
+		return nil, &IdError{Id: id, Err: ShortError}
 	}
-	if ns.generator != 'z' && len(digits) > len(ns.sizes) {
-		return -1
+	if ns.generator != 'z' && len(digits) > length {
+		return nil, &IdError{Id: id, Err: LongError}
+	}
+	if ns.checkDigit {
+		digits = digits[:len(digits)-1]
 	}
 	// translate the digits and see if they are the correct types
-	v := ns.ntoi(digits)
-
+	v, bad := ns.ntoi(digits)
+	if bad >= 0 {
+		return nil, &IdError{Id: id, Err: CharacterError, Position: start + bad + 1}
+	}
+	// does the checksum match?
+	if ns.checkDigit && checksum(ns.prefix()+digits) != id[end-1:end] {
+		if strings.IndexByte(XDigit, id[end-1]) == -1 {
+			return nil, &IdError{Id: id, Err: CharacterError, Position: end}
+		}
+		return nil, &IdError{Id: id, Err: CheckError}
+	}
 	// is the number too large?
-	if ns.max != -1 && v >= ns.max {
-		return -1
+	if ns.max.Sign() >= 0 && v.Cmp(ns.max) >= 0 {
+		return nil, &IdError{Id: id, Err: RangeError}
 	}
 
-	return v
+	return v, nil
 }
 
 // This is complicated since we want to use the same binning method as the ruby
@@ -236,114 +428,192 @@ func (ns noidState) valid(id string) int {
 // We assign numbers from each bin in sequence, but since the last bin is so
 // much smaller, it is exhausted first. The `cutoff` value tells us when the
 // smaller bin has been exhausted so we do not assign any more numbers to it.
+//
+// Bins all have the same size, so the bin a number falls in is found by
+// division rather than by searching a list of bin starting positions.
 type randomState struct {
-	binList   []int // list of bin starting positions
-	nBins     int   // actual number of bins
-	cutoff    int   // number which exhausts the smaller last bin
-	smallSize int   // the size of the small bin
-	askedFor  int   // the number of bins asked for
+	binSize   *big.Int // the size of every bin except the last one
+	nBins     *big.Int // actual number of bins
+	cutoff    *big.Int // number which exhausts the smaller last bin
+	smallSize *big.Int // the size of the small bin
+	askedFor  int      // the number of bins asked for
 }
 
-func newRandomState(binCount, countermax int) *randomState {
-	binSize := (countermax / binCount) + 1
-	smallBinSize := countermax % binSize
-	nBins := (countermax / binSize) + 1
-
-	bins := make([]int, nBins, nBins)
-	t := 0
-	for i := range bins {
-		bins[i] = t
-		t += binSize
-	}
+func newRandomState(binCount int, countermax *big.Int) *randomState {
+	var nBins, smallBinSize big.Int
+	binSize := new(big.Int).Quo(countermax, big.NewInt(int64(binCount)))
+	binSize.Add(binSize, bigOne)
+	nBins.QuoRem(countermax, binSize, &smallBinSize)
+	nBins.Add(&nBins, bigOne)
 
 	return &randomState{
-		binList:   bins,
-		nBins:     nBins,
-		cutoff:    nBins * smallBinSize,
+		binSize:   binSize,
+		nBins:     &nBins,
+		cutoff:    new(big.Int).Mul(&nBins, &smallBinSize),
 		askedFor:  binCount,
-		smallSize: smallBinSize,
+		smallSize: &smallBinSize,
 	}
 }
 
-func (rs randomState) swizzle(n int) int {
-	var bin, offset int
-	if n < rs.cutoff {
-		bin = n % rs.nBins
-		offset = n / rs.nBins
+func (rs randomState) swizzle(n *big.Int) *big.Int {
+	var bin, offset big.Int
+	if n.Cmp(rs.cutoff) < 0 {
+		offset.QuoRem(n, rs.nBins, &bin)
 	} else {
-		bin = (n - rs.cutoff) % (rs.nBins - 1)
-		offset = (n - rs.cutoff) / (rs.nBins - 1)
-		offset += rs.smallSize
+		var m, smallBins big.Int
+		m.Sub(n, rs.cutoff)
+		smallBins.Sub(rs.nBins, bigOne)
+		offset.QuoRem(&m, &smallBins, &bin)
+		offset.Add(&offset, rs.smallSize)
+	}
+	bin.Mul(&bin, rs.binSize)
+	return bin.Add(&bin, &offset)
+}
+
+func (rs randomState) invSwizzle(n *big.Int) *big.Int {
+	var bin, offset big.Int
+	bin.QuoRem(n, rs.binSize, &offset)
+	result := new(big.Int)
+	if offset.Cmp(rs.smallSize) < 0 {
+		result.Mul(rs.nBins, &offset)
+		return result.Add(result, &bin)
+	}
+	var smallBins big.Int
+	smallBins.Sub(rs.nBins, bigOne)
+	offset.Sub(&offset, rs.smallSize)
+	result.Mul(&smallBins, &offset)
+	result.Add(result, rs.cutoff)
+	return result.Add(result, &bin)
+}
+
+// feistelState is a keyed permutation of the numbers 0 <= n < max.
+// It is a Feistel network over the mixed-radix space [0, a*b), where a*b >= max,
+// with HMAC-SHA256 as the round function (this is the FE1 scheme of Bellare,
+// Ristenpart, Rogaway, and Stegers). Values which are permuted to a number
+// outside of [0, max) are permuted again until they land inside it ("cycle
+// walking"), so the result is a permutation of [0, max).
+type feistelState struct {
+	key  []byte
+	max  *big.Int
+	a, b *big.Int
+}
+
+const (
+	feistelRounds = 6
+	keySize       = 32
+)
+
+func newFeistelState(key []byte, max *big.Int) *feistelState {
+	// a = ceil(sqrt(max)), b = ceil(max / a)
+	a := new(big.Int).Sqrt(max)
+	if new(big.Int).Mul(a, a).Cmp(max) < 0 {
+		a.Add(a, bigOne)
 	}
-	return rs.binList[bin] + offset
+	b := new(big.Int).Add(max, a)
+	b.Sub(b, bigOne)
+	b.Quo(b, a)
+	return &feistelState{key: key, max: max, a: a, b: b}
 }
 
-func (rs randomState) invSwizzle(n int) int {
-	var bin, offset int
-	bin = rs.nBins - 1
-	for i := range rs.binList {
-		if rs.binList[i] > n {
-			bin = i - 1
-			break
+// round returns the value of the round function for round i and input r,
+// reduced modulo fs.a
+func (fs feistelState) round(i int, r *big.Int) *big.Int {
+	h := hmac.New(sha256.New, fs.key)
+	h.Write([]byte{byte(i)})
+	h.Write(r.Bytes())
+	v := new(big.Int).SetBytes(h.Sum(nil))
+	return v.Mod(v, fs.a)
+}
+
+func (fs feistelState) encrypt(n *big.Int) *big.Int {
+	var left, right big.Int
+	x := new(big.Int).Set(n)
+	for {
+		for i := 0; i < feistelRounds; i++ {
+			left.QuoRem(x, fs.b, &right)
+			left.Add(&left, fs.round(i, &right))
+			left.Mod(&left, fs.a)
+			x.Mul(fs.a, &right)
+			x.Add(x, &left)
+		}
+		if x.Cmp(fs.max) < 0 {
+			return x
 		}
 	}
-	offset = n - rs.binList[bin]
-	if offset < rs.smallSize {
-		return rs.nBins*offset + bin
+}
+
+func (fs feistelState) decrypt(n *big.Int) *big.Int {
+	var left, right big.Int
+	x := new(big.Int).Set(n)
+	for {
+		for i := feistelRounds - 1; i >= 0; i-- {
+			right.QuoRem(x, fs.a, &left)
+			left.Sub(&left, fs.round(i, &right))
+			left.Mod(&left, fs.a)
+			x.Mul(fs.b, &left)
+			x.Add(x, &right)
+		}
+		if x.Cmp(fs.max) < 0 {
+			return x
+		}
 	}
-	return rs.cutoff + (rs.nBins-1)*(offset-rs.smallSize) + bin
 }
 
 // Given an integer n inside the range of the template,
 // return the corresponding id string
-func (ns noidState) iton(n int) string {
+func (ns noidState) iton(n *big.Int) string {
 	var buffer []byte = make([]byte, 0, len(ns.sizes))
+	var value, size big.Int
 
-	for _, size := range ns.sizes {
-		value := n % size
-		n /= size
-		buffer = append(buffer, XDigit[value])
+	n = new(big.Int).Set(n)
+	for _, sz := range ns.sizes {
+		size.SetInt64(int64(sz))
+		n.QuoRem(n, &size, &value)
+		buffer = append(buffer, XDigit[value.Int64()])
 	}
 
 	if ns.generator == 'z' {
-		size := ns.sizes[len(ns.sizes)-1]
-		for n > 0 {
-			value := n % size
-			n /= size
-			buffer = append(buffer, XDigit[value])
+		size.SetInt64(int64(ns.sizes[len(ns.sizes)-1]))
+		for n.Sign() > 0 {
+			n.QuoRem(n, &size, &value)
+			buffer = append(buffer, XDigit[value.Int64()])
 		}
 	}
 
-	if n > 0 {
+	if n.Sign() > 0 {
 		// error, should be 0
 	}
 	return string(reverse(buffer))
 }
 
-func (ns noidState) ntoi(id string) int {
+// returns the value of the digits in id, and -1. If id contains a character
+// which is not a digit, returns the byte offset of that character instead.
+func (ns noidState) ntoi(id string) (*big.Int, int) {
 	// first translate each digit to an index
 	var digits []int = make([]int, len(id))
 	for i, c := range id {
 		digits[i] = strings.IndexRune(XDigit, c)
 		if digits[i] == -1 {
-			return -1
+			return nil, i
 		}
 	}
 	// now build up the value from back-to-front
-	var multiplier int = 1
-	var value int
+	var multiplier = big.NewInt(1)
+	var value = new(big.Int)
+	var term big.Int
 	var sizeIdx int = 0
 	for i := len(digits) - 1; i >= 0; i-- {
 		if ns.sizes[sizeIdx] <= digits[i] {
-			return -1
+			return nil, i
 		}
-		value += digits[i] * multiplier
-		multiplier *= ns.sizes[sizeIdx]
+		term.Mul(big.NewInt(int64(digits[i])), multiplier)
+		value.Add(value, &term)
+		multiplier.Mul(multiplier, big.NewInt(int64(ns.sizes[sizeIdx])))
 		if sizeIdx < len(ns.sizes)-1 {
 			sizeIdx++
 		}
 	}
-	return value
+	return value, -1
 }
 
 // This checksum function comes from the ruby noid gem
@@ -375,11 +645,11 @@ type template struct {
 	binCount   int
 	template   string
 	checkDigit bool
-	pos        int
+	pos        *big.Int // nil if the template has no position
 }
 
 var (
-	templateRegexp = regexp.MustCompile(`^(.*)\.([rsz])(\d*)([de]+)(k?)(\+\d+)?$`)
+	templateRegexp = regexp.MustCompile(`^(.*)\.([rszu])(\d*)([de]+)(k?)(\+\d+)?$`)
 )
 
 func parseTemplate(t string) (template, bool) {
@@ -400,7 +670,7 @@ func parseTemplate(t string) (template, bool) {
 	result.template = matches[4]
 	result.checkDigit = matches[5] == "k"
 	if len(matches[6]) > 1 {
-		result.pos, _ = strconv.Atoi(matches[6])
+		result.pos, _ = new(big.Int).SetString(matches[6][1:], 10)
 	}
 
 	if result.binCount > 0 && result.generator != 'r' {
@@ -1,6 +1,8 @@
 package noid
 
 import (
+	"errors"
+	"math/big"
 	"testing"
 )
 
@@ -21,14 +23,14 @@ func TestSwizzle(t *testing.T) {
 		{11, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
 	}
 	for _, e := range expected {
-		rs := newRandomState(e.count, 10)
+		rs := newRandomState(e.count, big.NewInt(10))
 		for i := 0; i < 10; i++ {
-			m := rs.swizzle(i)
-			if m != e.perm[i] {
+			m := rs.swizzle(big.NewInt(int64(i)))
+			if m.Int64() != int64(e.perm[i]) {
 				t.Errorf("%v bins, swizzle(%v) = %v != %v\n", e.count, i, m, e.perm[i])
 			}
 			j := rs.invSwizzle(m)
-			if j != i {
+			if j.Int64() != int64(i) {
 				t.Errorf("%v bins, invSwizzle(%v) = %v != %v\n", e.count, m, j, i)
 			}
 		}
@@ -75,19 +77,172 @@ func TestIndex(t *testing.T) {
 		n, _ := NewNoid(row.template)
 		for _, s := range row.valids {
 			x := n.Index(s)
-			if x == -1 {
+			if x.Sign() < 0 {
 				t.Errorf("%s gives Index(%s) = %v\n", row.template, s, x)
 			}
 		}
 		for _, s := range row.invalids {
 			x := n.Index(s)
-			if x != -1 {
+			if x.Sign() >= 0 {
 				t.Errorf("%s gives Index(%s) = %v\n", row.template, s, x)
 			}
 		}
 	}
 }
 
+func TestValidate(t *testing.T) {
+	table := []struct {
+		template string
+		id       string
+		err      error
+		position int
+	}{
+		{".sdk", "00", nil, 0},
+		{".sdk", "0", ShortError, 0},
+		{".sdk", "011", LongError, 0},
+		{".sdk", "b0", CharacterError, 1},
+		{".sdk", "0a", CharacterError, 2},
+		{".sdk", "5b", CheckError, 0},
+		{"slug..zdd", "slug.2345", nil, 0},
+		{"slug..zdd", "slog.2345", SlugError, 0},
+		{"slug..zdd", "slug.23b5", CharacterError, 8},
+		{".sede", "xj0", CharacterError, 2},
+		{".sede", "x-0", CharacterError, 2},
+	}
+
+	for _, row := range table {
+		n, _ := NewNoid(row.template)
+		_, err := n.Validate(row.id)
+		if !errors.Is(err, row.err) {
+			t.Errorf("%s gives Validate(%s) = %v, expected %v\n", row.template, row.id, err, row.err)
+			continue
+		}
+		if err != nil && err.(*IdError).Position != row.position {
+			t.Errorf("%s gives Validate(%s) = %v, expected position %d\n", row.template, row.id, err, row.position)
+		}
+	}
+
+	n, _ := NewNoid(".sdk")
+	_, err := n.Validate("b0")
+	if err == nil || err.Error() != `id "b0": bad character 'b' at position 1` {
+		t.Errorf("Got %v", err)
+	}
+	// pretend the pool only has 5 ids, so 99 is past the end
+	n, _ = NewNoid(".sdd")
+	n.(*noidState).max.SetInt64(5)
+	if _, err := n.Validate("99"); !errors.Is(err, RangeError) {
+		t.Errorf("Got %v", err)
+	}
+}
+
+func TestArk(t *testing.T) {
+	// example from the NOID specification
+	n, err := NewNoidOptions(".sddeedk", Options{NAAN: "13030", Shoulder: "xf"})
+	if err != nil {
+		t.Fatalf("Got error %v\n", err)
+	}
+	index, err := n.Validate("ark:/13030/xf93gt2q")
+	if err != nil {
+		t.Fatalf("Got error %v\n", err)
+	}
+	n.AdvanceTo(index)
+	if id := n.Mint(); id != "ark:/13030/xf93gt2q" {
+		t.Errorf("Mint() = %v\n", id)
+	}
+
+	valids := []string{
+		"ark:/13030/xf93gt2q",
+		"ark:13030/xf93gt2q",
+		"13030/xf93gt2q",
+		"xf93gt2q",
+		"ark:/13030/xf93gt2q/page1",
+		"ark:/13030/xf93gt2q.pdf",
+		"xf93gt2q/c/s.v",
+	}
+	for _, s := range valids {
+		x, err := n.Validate(s)
+		if err != nil || x.Cmp(index) != 0 {
+			t.Errorf("Validate(%s) = %v, %v\n", s, x, err)
+		}
+	}
+
+	invalids := []struct {
+		id  string
+		err error
+	}{
+		{"ark:/99999/xf93gt2q", SlugError},
+		{"ark:/13030/xg93gt2q", SlugError},
+		{"93gt2q", SlugError},
+		{"ark:/13030/xf93gt2r", CheckError},
+		{"ark:/13030/xf93gt2/page1", ShortError},
+	}
+	for _, row := range invalids {
+		_, err := n.Validate(row.id)
+		if !errors.Is(err, row.err) {
+			t.Errorf("Validate(%s) = %v, expected %v\n", row.id, err, row.err)
+		}
+	}
+
+	// errors point into the id as it was given
+	_, err = n.Validate("ark:/13030/xf9bgt2q")
+	if err == nil || err.(*IdError).Position != 15 {
+		t.Errorf("Got %v\n", err)
+	}
+
+	for _, opts := range []Options{{NAAN: "13-30"}, {Shoulder: "xf"}, {NAAN: "13030", Shoulder: "x/f"}} {
+		_, err := NewNoidOptions(".sddeedk", opts)
+		if err != ArkError {
+			t.Errorf("%v gives error %v\n", opts, err)
+		}
+	}
+}
+
+func TestKeyed(t *testing.T) {
+	_, err := NewNoid(".ude")
+	if err != KeyError {
+		t.Errorf("Got error %v\n", err)
+	}
+	if !NeedsKey(".udek") || NeedsKey(".rdek") {
+		t.Errorf("NeedsKey is wrong\n")
+	}
+
+	// every id is minted exactly once, and Index inverts Mint
+	for _, template := range []string{".ud", ".udek", ".ueed"} {
+		n, err := NewNoidOptions(template, Options{Key: []byte("secret")})
+		if err != nil {
+			t.Fatalf("Got error %v\n", err)
+		}
+		_, max := n.Count()
+		seen := make(map[string]bool)
+		for i := int64(0); i < max.Int64(); i++ {
+			id := n.Mint()
+			if seen[id] {
+				t.Fatalf("%s: %s minted twice\n", template, id)
+			}
+			seen[id] = true
+			if x := n.Index(id); x.Int64() != i {
+				t.Fatalf("%s: Index(%s) = %v, expected %v\n", template, id, x, i)
+			}
+		}
+		if id := n.Mint(); id != "" {
+			t.Errorf("%s: expected pool to be exhausted, got %v\n", template, id)
+		}
+	}
+
+	// different keys give different sequences
+	n1, _ := NewNoidOptions(".ueeeeee", Options{Key: []byte("one")})
+	n2, _ := NewNoidOptions(".ueeeeee", Options{Key: []byte("two")})
+	var same int
+	for i := 0; i < 20; i++ {
+		if n1.Mint() == n2.Mint() {
+			same++
+		}
+	}
+	if same > 1 {
+		t.Errorf("%d of 20 ids are the same with different keys\n", same)
+	}
+}
+
 func TestChecksum(t *testing.T) {
 	// TODO: add better test here using the expected checksums from ruby noid
 	//fmt.Println(checksum("abcdefg"))
@@ -108,3 +263,118 @@ func TestNoid(t *testing.T) {
 		}
 	}
 }
+
+func TestLargeTemplate(t *testing.T) {
+	// 29**13 is larger than 2**63
+	n, err := NewNoid(".seeeeeeeeeeeee+10260628712958602188")
+	if err != nil {
+		t.Fatalf("Got error %v\n", err)
+	}
+	pos, max := n.Count()
+	if pos.String() != "10260628712958602188" || max.String() != "10260628712958602189" {
+		t.Errorf("Count() = %v, %v\n", pos, max)
+	}
+	id := n.Mint()
+	if id != "zzzzzzzzzzzzz" {
+		t.Errorf("Mint() = %v\n", id)
+	}
+	if n.Mint() != "" {
+		t.Errorf("Expected pool to be exhausted\n")
+	}
+	if x := n.Index(id); x.String() != "10260628712958602188" {
+		t.Errorf("Index(%v) = %v\n", id, x)
+	}
+
+	// random templates past 2**63
+	n, err = NewNoid(".reeeeeeeeeeeeek")
+	if err != nil {
+		t.Fatalf("Got error %v\n", err)
+	}
+	pos, _ = new(big.Int).SetString("9223372036854775900", 10)
+	for i := 0; i < 100; i++ {
+		n.AdvanceTo(pos)
+		id := n.Mint()
+		if x := n.Index(id); x.Cmp(pos) != 0 {
+			t.Errorf("Index(%v) = %v, expected %v\n", id, x, pos)
+		}
+		pos.Add(pos, big.NewInt(1234567))
+	}
+
+	// z templates keep going past 2**63
+	n, _ = NewNoid(".zd+9223372036854775807")
+	n.Mint()
+	if id := n.Mint(); id != "9223372036854775808" {
+		t.Errorf("Mint() = %v\n", id)
+	}
+}
+
+func TestPositionTooLarge(t *testing.T) {
+	_, err := NewNoid(".sdd+101")
+	if err != PositionError {
+		t.Errorf("Got error %v\n", err)
+	}
+	_, err = NewNoid(".sdd+100")
+	if err != nil {
+		t.Errorf("Got error %v\n", err)
+	}
+}
+
+// simulates a ruby noid minter for the template .reek and checks that the
+// ids minted after advancing to the LegacyPosition are all new.
+func TestLegacyPosition(t *testing.T) {
+	const template = ".reek"
+	n, _ := NewNoid(template)
+	_, max := n.Count()
+	rs := n.(*noidState).r
+
+	// make the counters the way the ruby gem does
+	var counters []Counter
+	for i := int64(0); i < rs.nBins.Int64(); i++ {
+		start := new(big.Int).Mul(big.NewInt(i), rs.binSize)
+		end := new(big.Int).Add(start, rs.binSize)
+		if end.Cmp(max) > 0 {
+			end.Set(max)
+		}
+		counters = append(counters, Counter{Value: start, Max: end})
+	}
+
+	// mint 500 ids at "random"
+	seq, _ := NewNoid(".seek")
+	minted := make(map[string]bool)
+	for i := 0; i < 500; i++ {
+		c := &counters[(i*7919)%len(counters)]
+		if c.Value.Cmp(c.Max) == 0 {
+			continue
+		}
+		seq.AdvanceTo(c.Value)
+		minted[seq.Mint()] = true
+		c.Value = new(big.Int).Add(c.Value, big.NewInt(1))
+	}
+	// the ruby gem deletes exhausted counters
+	var remaining []Counter
+	for _, c := range counters {
+		if c.Value.Cmp(c.Max) < 0 {
+			remaining = append(remaining, c)
+		}
+	}
+
+	pos, err := LegacyPosition(template, big.NewInt(int64(len(minted))), remaining)
+	if err != nil {
+		t.Fatalf("Got error %v\n", err)
+	}
+	n.AdvanceTo(pos)
+	for id := n.Mint(); id != ""; id = n.Mint() {
+		if minted[id] {
+			t.Fatalf("%s was minted again, position %v\n", id, pos)
+		}
+	}
+
+	pos, err = LegacyPosition(".sdd", big.NewInt(15), nil)
+	if err != nil || pos.Int64() != 15 {
+		t.Errorf("Got %v, %v\n", pos, err)
+	}
+	_, err = LegacyPosition(template, big.NewInt(5), []Counter{{Value: big.NewInt(5), Max: big.NewInt(900)}})
+	if err != CounterError {
+		t.Errorf("Got error %v\n", err)
+	}
+}
@@ -3,8 +3,14 @@ package main
 import (
 	"errors"
 	"log"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/ndlib/noids/noid"
 )
@@ -13,11 +19,93 @@ import (
 // use separate structures since the private structure contains
 // a mutex we do not wish to copy. The private structure is
 // the canonical source.
+// Used and Max are serialized as JSON numbers, and may be larger
+// than 2**53.
+// NAAN and Shoulder are set for pools which mint ARKs.
+// Description, Owner, and Tags are free-form information for people
+// managing the pools, and do not affect minting.
+// Exclusions lists ids the pool will never mint, and Skipped is the
+// number of ids which have been skipped because they were excluded.
+// Reservations are the outstanding reservations, and Recycled are
+// ids which were reserved and then released, which will be handed out
+// before any new ids are minted.
+// BlockSize, if not zero, is how many ids the pool leases from its store
+// at a time. Leased is the position recorded in the store, which the pool
+// may mint up to without saving. If the server stops, the ids between
+// Used and Leased are never minted. AdvancedTo is the position the pool
+// was last moved to by advancing past an id. Servers sharing the store
+// skip the part of their block before it.
+// Key is the secret used by keyed templates, and MintRecords are the
+// recent mint requests made with an idempotency key. They are only
+// filled in when the PoolInfo is passed to a PoolStore, and are never
+// returned from the pool group.
+// Degraded is set if the last attempt to save the pool failed, or if it
+// was restored from a backup by its store.
 type PoolInfo struct {
 	Name, Template string
-	Used, Max      int
+	Used, Max      *big.Int
+	Leased         *big.Int `json:",omitempty"`
+	AdvancedTo     *big.Int `json:",omitempty"`
+	BlockSize      int64    `json:",omitempty"`
+	Skipped        int64
 	Closed         bool
+	Created        time.Time
 	LastMint       time.Time
+	NAAN           string            `json:",omitempty"`
+	Shoulder       string            `json:",omitempty"`
+	Description    string            `json:",omitempty"`
+	Owner          string            `json:",omitempty"`
+	Tags           map[string]string `json:",omitempty"`
+	Exclusions     *Exclusions       `json:",omitempty"`
+	Reservations   []Reservation     `json:",omitempty"`
+	Recycled       []string          `json:",omitempty"`
+	Degraded       bool              `json:",omitempty"`
+	Key            []byte            `json:",omitempty"`
+	MintRecords    []MintRecord      `json:",omitempty"`
+}
+
+// A MintRecord remembers the ids returned for a mint request made with
+// an idempotency key, so a repeated request returns the same ids.
+type MintRecord struct {
+	Key   string
+	Count int
+	Ids   []string
+	Time  time.Time
+}
+
+// A StoreError is returned when a pool could not be saved to its store.
+// The change which was being saved is undone.
+type StoreError struct {
+	Name string
+	Err  error
+}
+
+func (e *StoreError) Error() string {
+	return "Pool " + e.Name + " could not be saved: " + e.Err.Error()
+}
+
+func (e *StoreError) Unwrap() error {
+	return e.Err
+}
+
+// PoolUpdate lists changes to the descriptive fields of a pool.
+// Nil fields are left unchanged. A tag with an empty value is removed.
+// Exclusions, if given, replaces all of the pool's exclusions.
+type PoolUpdate struct {
+	Description *string
+	Owner       *string
+	Tags        map[string]string
+	Exclusions  *Exclusions
+	BlockSize   *int64
+}
+
+// A Tombstone is left in place of a deleted pool. It keeps the
+// pool's name from being used again, since ids minted by the old pool
+// may still be in use.
+type Tombstone struct {
+	Name, Template string
+	NAAN           string `json:",omitempty"`
+	Deleted        time.Time
 }
 
 type pool struct {
@@ -25,15 +113,65 @@ type pool struct {
 	noid     noid.Noid
 	closed   bool
 	empty    bool
+	deleted  bool
+	degraded bool
+	created  time.Time
 	lastMint time.Time
 	name     string
+	naan     string
+	shoulder string
+	key      []byte
 	store    PoolStore
+
+	// saved is signaled when a batch of changes has been saved. saving
+	// is set while the pool is being saved, writing is the batch being
+	// saved, and batch holds the changes waiting for the next save. See
+	// commit.go.
+	saved   *sync.Cond
+	saving  bool
+	writing *commitBatch
+	batch   *commitBatch
+
+	// shared is set if store is a SharedStore, and version is the
+	// version of the pool last loaded from or saved to it.
+	shared  SharedStore
+	version int64
+
+	description string
+	owner       string
+	tags        map[string]string
+	exclusions  *Exclusions
+	exclude     *exclusionFilter
+	skipped     int64
+
+	// blockSize is the number of ids leased at a time. If it is
+	// not zero, stored is the position recorded in the store, and
+	// leased is the end of the block this server may mint from.
+	// They differ only if other servers share the store.
+	// advancedTo is the position recorded by the last advancePast,
+	// which every server sharing the store must mint after.
+	blockSize  int64
+	leased     *big.Int
+	stored     *big.Int
+	advancedTo *big.Int
+
+	reservations map[string]Reservation
+	recycled     []string
+	mintRecords  map[string]MintRecord
+
+	// bindings caches the bindings read from the store, by id index.
+	// An id without bindings is cached as an empty map.
+	bindings map[string]map[string]string
 }
 
 type poolGroup struct {
 	sync.RWMutex
 	table map[string]*pool
 	names []string
+	tombs map[string]Tombstone
+
+	// saved pools which could not be loaded
+	skipped []SkippedRecord
 }
 
 var (
@@ -43,31 +181,126 @@ var (
 	NoSuchPool = errors.New("Pool could not be found")
 	PoolEmpty  = errors.New("Pool is empty")
 	PoolClosed = errors.New("Pool is closed")
-	InvalidId  = errors.New("Id is invalid for this counter")
+	PoolOpen   = errors.New("Pool must be closed before it is deleted")
+	NotMinted  = errors.New("Id has not been minted")
+	NameUsed   = errors.New("Name belongs to a deleted pool")
+	KeyReused  = errors.New("Idempotency key was used for a different request")
+
+	BadBlockSize = errors.New("Block size must not be negative")
+	BadPoolName  = errors.New(`Pool names must be 1 to 255 bytes of UTF-8, must not be "." or "..", and must not contain "/", spaces, or control characters`)
+
+	// how long a mint request's idempotency key is remembered
+	IdempotencyWindow = 24 * time.Hour
+
+	// the most excluded ids PoolMint will skip in one call, so a pool
+	// whose exclusions match everything cannot hang the server.
+	maxSkips = 100000
+
+	// how many times to retry a change to a pool in a SharedStore
+	// which keeps being changed by other servers
+	maxConflicts = 10
+
+	// the most bindings to cache for each pool
+	maxCachedBindings = 10000
+
+	// the largest integer every JSON parser can represent exactly
+	maxExactJSON = new(big.Int).Lsh(big.NewInt(1), 53)
 )
 
 func NewPoolGroup() *poolGroup {
-	return &poolGroup{table: make(map[string]*pool)}
+	return &poolGroup{
+		table: make(map[string]*pool),
+		tombs: make(map[string]Tombstone),
+	}
+}
+
+// validPoolName returns BadPoolName if name may not be used for a new
+// pool. A name must be usable as a single part of a URL path.
+func validPoolName(name string) error {
+	if name == "" || len(name) > 255 || name == "." || name == ".." || !utf8.ValidString(name) {
+		return BadPoolName
+	}
+	for _, r := range name {
+		if r == '/' || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return BadPoolName
+		}
+	}
+	return nil
 }
 
 // Create a new pool having the given name and template.
 func (pg *poolGroup) AddPool(name, template string) (PoolInfo, error) {
-	pi := PoolInfo{
-		Name:     name,
-		Template: template,
-		LastMint: time.Now(),
+	return pg.CreatePool(PoolInfo{Name: name, Template: template})
+}
+
+// CreatePool makes a new pool using the Name, Template, the ARK
+// settings, and the descriptive fields in pi. The other fields of pi
+// are ignored.
+// If the template needs a key, a new random one is made for the pool.
+func (pg *poolGroup) CreatePool(pi PoolInfo) (PoolInfo, error) {
+	err := validPoolName(pi.Name)
+	if err != nil {
+		return pi, err
+	}
+	now := time.Now()
+	pi = PoolInfo{
+		Name:        pi.Name,
+		Template:    pi.Template,
+		NAAN:        pi.NAAN,
+		Shoulder:    pi.Shoulder,
+		Description: pi.Description,
+		Owner:       pi.Owner,
+		Tags:        copyTags(pi.Tags),
+		Exclusions:  pi.Exclusions,
+		BlockSize:   pi.BlockSize,
+		Created:     now,
+		LastMint:    now,
+	}
+	if noid.NeedsKey(pi.Template) {
+		key, err := noid.NewKey()
+		if err != nil {
+			return pi, err
+		}
+		pi.Key = key
 	}
-	err := pg.loadFromInfo(&pi)
+	err = pg.loadFromInfo(&pi)
 	if err == nil {
-		err = DefaultStore.SavePool(name, pi)
+		if shared, ok := DefaultStore.(SharedStore); ok {
+			err = shared.InsertPool(pi.Name, pi)
+		} else {
+			err = DefaultStore.SavePool(pi.Name, pi)
+		}
+		if err != nil {
+			pg.Lock()
+			pg.remove(pi.Name)
+			pg.Unlock()
+			if err != NameExists && err != NameUsed {
+				err = &StoreError{Name: pi.Name, Err: err}
+			}
+		}
 	}
+	pi.Key = nil
 	return pi, err
 }
 
 // AllPools returns a list of names for every pool in the system.
+// If the pools are shared with other servers, the list is read from
+// the store.
 func (pg *poolGroup) AllPools() []string {
-	pools.RLock()
-	defer pools.RUnlock()
+	if shared, ok := DefaultStore.(SharedStore); ok {
+		pis, err := shared.LoadAllPools()
+		if err == nil {
+			result := make([]string, 0, len(pis))
+			for _, pi := range pis {
+				result = append(result, pi.Name)
+			}
+			return result
+		}
+		log.Println("Error:", err)
+	}
+
+	pg.RLock()
+	defer pg.RUnlock()
 
 	result := make([]string, len(pg.names))
 	copy(result, pg.names)
@@ -75,6 +308,70 @@ func (pg *poolGroup) AllPools() []string {
 	return result
 }
 
+// AllTombstones returns the tombstones of every deleted pool, sorted by name.
+func (pg *poolGroup) AllTombstones() []Tombstone {
+	pg.RLock()
+	defer pg.RUnlock()
+
+	result := make([]Tombstone, 0, len(pg.tombs))
+	for _, tomb := range pg.tombs {
+		result = append(result, tomb)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	return result
+}
+
+// DeletePool removes the named pool from the group and its store, and
+// leaves a tombstone so the name cannot be used again.
+// The pool must be closed first, otherwise PoolOpen is returned.
+func (pg *poolGroup) DeletePool(name string) (Tombstone, error) {
+	tomb := Tombstone{Name: name}
+
+	pg.Lock()
+	defer pg.Unlock()
+	p := pg.table[name]
+	if p == nil {
+		return tomb, NoSuchPool
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	// the pool must not be saved after it is deleted
+	p.waitForSaves()
+	if err := p.refresh(); err != nil {
+		return tomb, err
+	}
+	if !p.closed {
+		return tomb, PoolOpen
+	}
+	tomb.Template = p.noid.String()
+	tomb.NAAN = p.naan
+	tomb.Deleted = time.Now()
+	err := p.store.DeletePool(name, tomb)
+	if err != nil {
+		return tomb, &StoreError{Name: name, Err: err}
+	}
+	// anyone who looked up p before now will see it is deleted
+	p.deleted = true
+	pg.remove(name)
+	pg.tombs[name] = tomb
+	return tomb, nil
+}
+
+// remove takes the named pool out of the group.
+// expects the caller to be holding the lock on pg
+func (pg *poolGroup) remove(name string) {
+	delete(pg.table, name)
+	for i := range pg.names {
+		if pg.names[i] == name {
+			pg.names = append(pg.names[:i], pg.names[i+1:]...)
+			break
+		}
+	}
+}
+
 func (pg *poolGroup) lookupPool(name string) (*pool, error) {
 	var err error = nil
 
@@ -83,11 +380,33 @@ func (pg *poolGroup) lookupPool(name string) (*pool, error) {
 	pg.RUnlock()
 
 	if p == nil {
+		if shared, ok := DefaultStore.(SharedStore); ok {
+			// the pool may have been made by another server
+			return pg.loadShared(shared, name)
+		}
 		err = NoSuchPool
 	}
 	return p, err
 }
 
+// loadShared adds the pool `name` from a SharedStore to the group.
+func (pg *poolGroup) loadShared(shared SharedStore, name string) (*pool, error) {
+	pi, _, err := shared.LoadPool(name)
+	if err == NoSuchPool {
+		return nil, err
+	} else if err != nil {
+		return nil, &StoreError{Name: name, Err: err}
+	}
+	err = pg.loadFromInfo(&pi)
+	if err != nil && err != NameExists {
+		return nil, err
+	}
+	pg.RLock()
+	p := pg.table[name]
+	pg.RUnlock()
+	return p, nil
+}
+
 // Get information on the pool named.
 // Returns an error if the given pool could not be found.
 func (pg *poolGroup) GetPool(name string) (PoolInfo, error) {
@@ -100,6 +419,10 @@ func (pg *poolGroup) GetPool(name string) (PoolInfo, error) {
 	p.Lock()
 	defer p.Unlock()
 
+	if err := p.refresh(); err != nil {
+		return result, err
+	}
+	p.expireReservations()
 	copyPoolInfo(&result, p)
 	return result, nil
 }
@@ -111,12 +434,325 @@ func copyPoolInfo(pi *PoolInfo, p *pool) {
 	pi.Template = p.noid.String()
 	pi.Used, pi.Max = p.noid.Count()
 	pi.Closed = p.closed
+	pi.Created = p.created
 	pi.LastMint = p.lastMint
+	pi.NAAN = p.naan
+	pi.Shoulder = p.shoulder
+	pi.Description = p.description
+	pi.Owner = p.owner
+	pi.Tags = copyTags(p.tags)
+	pi.Exclusions = p.exclusions
+	pi.Skipped = p.skipped
+	// the tokens are only given to the client which made the reservation
+	pi.Reservations = copyReservations(p)
+	for i := range pi.Reservations {
+		pi.Reservations[i].Token = ""
+	}
+	pi.Recycled = append([]string(nil), p.recycled...)
+	pi.Degraded = p.degraded
+	pi.BlockSize = p.blockSize
+	pi.Leased = nil
+	if p.stored != nil {
+		pi.Leased = new(big.Int).Set(p.stored)
+	}
+}
+
+// copyTags returns a copy of tags, or nil if there are none.
+func copyTags(tags map[string]string) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	result := make(map[string]string, len(tags))
+	for k, v := range tags {
+		result[k] = v
+	}
+	return result
+}
+
+// saveInfo returns the information about p to pass to its store, which
+// includes private settings which are not part of the public pool
+// information.
+// expects the caller to be holding the lock on p
+func (p *pool) saveInfo() PoolInfo {
+	pi := PoolInfo{Name: p.name}
+	copyPoolInfo(&pi, p)
+	pi.Key = p.key
+	pi.Reservations = copyReservations(p)
+	pi.AdvancedTo = p.advancedTo
+	pi.Degraded = false
+	pi.MintRecords = nil
+	for _, rec := range p.mintRecords {
+		pi.MintRecords = append(pi.MintRecords, rec)
+	}
+	sort.Slice(pi.MintRecords, func(i, j int) bool {
+		return pi.MintRecords[i].Time.Before(pi.MintRecords[j].Time)
+	})
+	if p.stored != nil {
+		// the store records the end of the lease, so ids in the
+		// block are never minted again after a restart
+		pi.Template = pi.Template[:strings.LastIndex(pi.Template, "+")+1] + p.stored.String()
+		pi.Used = new(big.Int).Set(p.stored)
+	}
+	return pi
+}
+
+// refresh reloads p from its store, if the store is shared with other
+// servers. Returns NoSuchPool if another server deleted the pool.
+// expects the caller to be holding the lock on p
+func (p *pool) refresh() error {
+	if p.shared == nil {
+		return nil
+	}
+	if p.deleted {
+		return NoSuchPool
+	}
+	pi, version, err := p.shared.LoadPool(p.name)
+	if err == NoSuchPool {
+		p.deleted = true
+		return err
+	} else if err != nil {
+		return &StoreError{Name: p.name, Err: err}
+	}
+	if version == p.version {
+		return nil
+	}
+	position, err := templatePosition(pi.Template)
+	if err != nil {
+		return err
+	}
+	exclude := p.exclude
+	if !reflect.DeepEqual(pi.Exclusions, p.exclusions) {
+		exclude, err = newExclusionFilter(pi.Exclusions)
+		if err != nil {
+			return err
+		}
+	}
+	p.blockSize = pi.BlockSize
+	if p.blockSize > 0 {
+		// keep minting from the block this server leased, if any
+		if p.leased == nil {
+			p.noid.AdvanceTo(position)
+			p.leased = position
+		}
+		p.stored = position
+	} else {
+		p.noid.AdvanceTo(position)
+		p.leased = nil
+		p.stored = nil
+	}
+	p.advancedTo = pi.AdvancedTo
+	if current, _ := p.noid.Count(); p.advancedTo != nil && current.Cmp(p.advancedTo) < 0 {
+		// another server advanced past ids in this server's block
+		p.noid.AdvanceTo(p.advancedTo)
+		if p.leased != nil && p.leased.Cmp(p.advancedTo) < 0 {
+			p.leased = new(big.Int).Set(p.advancedTo)
+		}
+	}
+	current, max := p.noid.Count()
+	p.empty = current.Cmp(max) == 0
+	p.closed = pi.Closed
+	p.lastMint = pi.LastMint
+	p.skipped = pi.Skipped
+	p.recycled = pi.Recycled
+	p.reservations = nil
+	for _, r := range pi.Reservations {
+		if p.reservations == nil {
+			p.reservations = make(map[string]Reservation)
+		}
+		p.reservations[r.Token] = r
+	}
+	p.mintRecords = nil
+	for _, rec := range pi.MintRecords {
+		if p.mintRecords == nil {
+			p.mintRecords = make(map[string]MintRecord)
+		}
+		p.mintRecords[rec.Key] = rec
+	}
+	p.description = pi.Description
+	p.owner = pi.Owner
+	p.tags = pi.Tags
+	p.exclusions = pi.Exclusions
+	p.exclude = exclude
+	p.version = version
+	return nil
+}
+
+// templatePosition returns the position at the end of an extended template.
+func templatePosition(template string) (*big.Int, error) {
+	i := strings.LastIndex(template, "+")
+	if i < 0 {
+		return new(big.Int), nil
+	}
+	position, ok := new(big.Int).SetString(template[i+1:], 10)
+	if !ok {
+		return nil, noid.PositionError
+	}
+	return position, nil
+}
+
+// poolState holds the parts of a pool which may change, so that a
+// change can be undone.
+type poolState struct {
+	position     *big.Int
+	closed       bool
+	empty        bool
+	lastMint     time.Time
+	skipped      int64
+	recycled     []string
+	reservations map[string]Reservation
+	mintRecords  map[string]MintRecord
+	description  string
+	owner        string
+	tags         map[string]string
+	exclusions   *Exclusions
+	exclude      *exclusionFilter
+	blockSize    int64
+	leased       *big.Int
+	stored       *big.Int
+	advancedTo   *big.Int
+}
+
+// snapshot returns the current state of p.
+// expects the caller to be holding the lock on p
+func (p *pool) snapshot() poolState {
+	position, _ := p.noid.Count()
+	s := poolState{
+		position:    new(big.Int).Set(position),
+		closed:      p.closed,
+		empty:       p.empty,
+		lastMint:    p.lastMint,
+		skipped:     p.skipped,
+		recycled:    append([]string(nil), p.recycled...),
+		description: p.description,
+		owner:       p.owner,
+		tags:        copyTags(p.tags),
+		exclusions:  p.exclusions,
+		exclude:     p.exclude,
+		blockSize:   p.blockSize,
+		leased:      p.leased,
+		stored:      p.stored,
+		advancedTo:  p.advancedTo,
+	}
+	if p.reservations != nil {
+		s.reservations = make(map[string]Reservation, len(p.reservations))
+		for k, v := range p.reservations {
+			s.reservations[k] = v
+		}
+	}
+	if p.mintRecords != nil {
+		s.mintRecords = make(map[string]MintRecord, len(p.mintRecords))
+		for k, v := range p.mintRecords {
+			s.mintRecords[k] = v
+		}
+	}
+	return s
+}
+
+// restore puts p back into the state s.
+// expects the caller to be holding the lock on p
+func (p *pool) restore(s poolState) {
+	p.noid.AdvanceTo(s.position)
+	p.closed = s.closed
+	p.empty = s.empty
+	p.lastMint = s.lastMint
+	p.skipped = s.skipped
+	p.recycled = s.recycled
+	p.reservations = s.reservations
+	p.mintRecords = s.mintRecords
+	p.description = s.description
+	p.owner = s.owner
+	p.tags = s.tags
+	p.exclusions = s.exclusions
+	p.exclude = s.exclude
+	p.blockSize = s.blockSize
+	p.leased = s.leased
+	p.stored = s.stored
+	p.advancedTo = s.advancedTo
+}
+
+// update calls change, which may alter p, and saves p if change returns
+// true. If the save fails, p is put back the way it was before change,
+// marked as degraded, and a *StoreError is returned. Otherwise the error
+// returned by change is returned.
+// The lock on p is released while p is being saved, and changes made
+// by other requests in the meantime are saved together by the next save.
+// expects the caller to be holding the lock on p
+func (p *pool) update(change func() (bool, error)) error {
+	if p.shared != nil {
+		return p.updateShared(change)
+	}
+	var before poolState
+	if p.batch == nil {
+		before = p.snapshot()
+	}
+	changed, err := change()
+	if !changed {
+		// ids minted from a lease may only be handed out once the
+		// save which took the lease is written
+		if serr := p.waitForBatch(); serr != nil && err == nil {
+			return serr
+		}
+		return err
+	}
+	if serr := p.commit(before); serr != nil {
+		return serr
+	}
+	return err
+}
+
+// updateShared is update for a pool in a SharedStore. p is reloaded
+// before change is called, and if another server changed the pool before
+// p was saved, change is tried again on the reloaded pool. So change may
+// be called more than once. The lock on p is held while it is saved.
+// expects the caller to be holding the lock on p
+func (p *pool) updateShared(change func() (bool, error)) error {
+	for attempt := 1; ; attempt++ {
+		if err := p.refresh(); err != nil {
+			return err
+		}
+		before := p.snapshot()
+		changed, err := change()
+		if !changed {
+			return err
+		}
+		version, serr := p.shared.SavePoolVersion(p.name, p.saveInfo(), p.version)
+		if serr == nil {
+			p.version = version
+		}
+		if serr == VersionConflict && attempt < maxConflicts {
+			log.Printf("Pool %s was changed by another server, trying again", p.name)
+			p.restore(before)
+			continue
+		}
+		if serr == NoSuchPool {
+			p.deleted = true
+			return serr
+		}
+		if serr != nil {
+			log.Printf("Error saving pool %s, undoing the change: %s", p.name, serr.Error())
+			p.restore(before)
+			p.degraded = true
+			return &StoreError{Name: p.name, Err: serr}
+		}
+		p.degraded = false
+		return err
+	}
+}
+
+// pruneMintRecords removes the mint records older than IdempotencyWindow.
+// expects the caller to be holding the lock on p
+func (p *pool) pruneMintRecords() {
+	cutoff := time.Now().Add(-IdempotencyWindow)
+	for key, rec := range p.mintRecords {
+		if rec.Time.Before(cutoff) {
+			delete(p.mintRecords, key)
+		}
+	}
 }
 
 // Mark the named pool as either open (false) or closed (false).
-// If the pool is empty, a PoolEmpty error is returned and the pool
-// remains closed.
+// If the pool is empty and has no recycled ids, a PoolEmpty error is
+// returned and the pool remains closed.
 func (pg *poolGroup) SetPoolState(name string, makeClosed bool) (PoolInfo, error) {
 	pi := PoolInfo{Name: name}
 	p, err := pg.lookupPool(name)
@@ -127,26 +763,202 @@ func (pg *poolGroup) SetPoolState(name string, makeClosed bool) (PoolInfo, error
 	p.Lock()
 	defer p.Unlock()
 
-	var needSave = false
-	if !makeClosed && p.empty {
-		copyPoolInfo(&pi, p)
-		return pi, PoolEmpty
+	if p.deleted {
+		return pi, NoSuchPool
 	}
-	if p.closed != makeClosed {
+	err = p.update(func() (bool, error) {
+		if !makeClosed && p.empty && len(p.recycled) == 0 {
+			return false, PoolEmpty
+		}
+		if p.closed == makeClosed {
+			return false, nil
+		}
 		p.closed = makeClosed
-		needSave = true
+		return true, nil
+	})
+	copyPoolInfo(&pi, p)
+	return pi, err
+}
+
+// UpdatePool changes the descriptive fields of the pool named.
+// Returns the updated pool info.
+func (pg *poolGroup) UpdatePool(name string, u PoolUpdate) (PoolInfo, error) {
+	pi := PoolInfo{Name: name}
+	p, err := pg.lookupPool(name)
+	if err != nil {
+		return pi, err
 	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.deleted {
+		return pi, NoSuchPool
+	}
+	if u.BlockSize != nil && *u.BlockSize < 0 {
+		copyPoolInfo(&pi, p)
+		return pi, BadBlockSize
+	}
+	var exclude *exclusionFilter
+	if u.Exclusions != nil {
+		exclude, err = newExclusionFilter(u.Exclusions)
+		if err != nil {
+			copyPoolInfo(&pi, p)
+			return pi, err
+		}
+	}
+	err = p.update(func() (bool, error) {
+		if u.Exclusions != nil {
+			p.exclude = exclude
+			p.exclusions = nil
+			if exclude != nil {
+				p.exclusions = u.Exclusions
+			}
+		}
+		if u.BlockSize != nil {
+			p.setBlockSize(*u.BlockSize)
+		}
+		if u.Description != nil {
+			p.description = *u.Description
+		}
+		if u.Owner != nil {
+			p.owner = *u.Owner
+		}
+		for k, v := range u.Tags {
+			if v == "" {
+				delete(p.tags, k)
+				continue
+			}
+			if p.tags == nil {
+				p.tags = make(map[string]string)
+			}
+			p.tags[k] = v
+		}
+		return true, nil
+	})
 	copyPoolInfo(&pi, p)
-	if needSave {
-		p.store.SavePool(p.name, pi)
+	return pi, err
+}
+
+// mintedIndex returns the index of id as a string, or an error if the
+// pool has not minted id. Ids which were skipped are not minted.
+// expects the caller to be holding the lock on p
+func (p *pool) mintedIndex(id string) (string, error) {
+	if p.deleted {
+		return "", NoSuchPool
+	}
+	index, err := p.noid.Validate(id)
+	if err != nil {
+		return "", err
+	}
+	position, _ := p.noid.Count()
+	if index.Cmp(position) >= 0 || (p.exclude != nil && p.exclude.excluded(id)) {
+		return "", NotMinted
 	}
-	return pi, nil
+	return index.String(), nil
+}
+
+// loadBinding returns the bindings for the id with the given index,
+// reading them from the store if they are not cached.
+// expects the caller to be holding the lock on p
+func (p *pool) loadBinding(index string) (map[string]string, error) {
+	b, ok := p.bindings[index]
+	// other servers may change the bindings of a shared pool
+	if ok && p.shared == nil {
+		return b, nil
+	}
+	b, err := p.store.LoadBinding(p.name, index)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		b = make(map[string]string)
+	}
+	if p.bindings == nil || len(p.bindings) >= maxCachedBindings {
+		p.bindings = make(map[string]map[string]string)
+	}
+	p.bindings[index] = b
+	return b, nil
+}
+
+// GetBindings returns the key/value bindings of id, which must have
+// been minted by the pool named. The result is empty if id has no bindings.
+// Any of the forms of id accepted by the pool may be used.
+func (pg *poolGroup) GetBindings(name, id string) (map[string]string, error) {
+	p, err := pg.lookupPool(name)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if err := p.refresh(); err != nil {
+		return nil, err
+	}
+	index, err := p.mintedIndex(id)
+	if err != nil {
+		return nil, err
+	}
+	b, err := p.loadBinding(index)
+	return copyTags(b), err
+}
+
+// SetBindings changes the bindings of id, which must have been minted
+// by the pool named. Bindings with an empty value are removed, and the
+// others are added or replaced. Returns the updated bindings.
+func (pg *poolGroup) SetBindings(name, id string, changes map[string]string) (map[string]string, error) {
+	p, err := pg.lookupPool(name)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if err := p.refresh(); err != nil {
+		return nil, err
+	}
+	index, err := p.mintedIndex(id)
+	if err != nil {
+		return nil, err
+	}
+	old, err := p.loadBinding(index)
+	if err != nil {
+		return nil, err
+	}
+	b := copyTags(old)
+	if b == nil {
+		b = make(map[string]string)
+	}
+	for k, v := range changes {
+		if v == "" {
+			delete(b, k)
+		} else {
+			b[k] = v
+		}
+	}
+	err = p.store.SaveBinding(p.name, index, b)
+	if err != nil {
+		return copyTags(old), &StoreError{Name: p.name, Err: err}
+	}
+	p.bindings[index] = b
+	return copyTags(b), nil
 }
 
 // Mint the given number of ids from the pool named.
+// Recycled ids are handed out first, and excluded ids are skipped over.
 // Less ids than requested may be returned if the pool
-// is empty or closed.
+// is empty or closed, or if too many ids in a row are excluded.
 func (pg *poolGroup) PoolMint(name string, count int) ([]string, error) {
+	return pg.PoolMintKey(name, "", count)
+}
+
+// PoolMintKey mints ids as PoolMint does. If key is not empty and a request
+// with the same key was made within IdempotencyWindow, the ids returned
+// by that request are returned again, and the pool is not changed.
+// It is an error to reuse a key with a different count.
+func (pg *poolGroup) PoolMintKey(name, key string, count int) ([]string, error) {
 	var result []string = make([]string, 0, count)
 	p, err := pg.lookupPool(name)
 	if err != nil {
@@ -156,32 +968,152 @@ func (pg *poolGroup) PoolMint(name string, count int) ([]string, error) {
 	p.Lock()
 	defer p.Unlock()
 
-	if p.closed {
-		return result, PoolClosed
+	if p.deleted {
+		return result, NoSuchPool
+	}
+	if key != "" {
+		// an earlier request with the key may still be saving
+		p.waitForSaves()
+	}
+	var minted []string
+	err = p.update(func() (bool, error) {
+		// the key is checked here since another server sharing
+		// the pool may have used it
+		if key != "" {
+			p.pruneMintRecords()
+			if rec, ok := p.mintRecords[key]; ok {
+				if rec.Count != count {
+					return false, KeyReused
+				}
+				minted = rec.Ids
+				return false, nil
+			}
+		}
+		expired := p.expireReservations()
+		if p.closed {
+			return expired, PoolClosed
+		}
+		ids, changed := p.mint(count)
+		if len(ids) > 0 {
+			p.lastMint = time.Now()
+			if key != "" {
+				if p.mintRecords == nil {
+					p.mintRecords = make(map[string]MintRecord)
+				}
+				p.mintRecords[key] = MintRecord{
+					Key:   key,
+					Count: count,
+					Ids:   append([]string(nil), ids...),
+					Time:  p.lastMint,
+				}
+				// save the record even if the ids were leased
+				changed = true
+			}
+		}
+		minted = ids
+		return changed || expired, nil
+	})
+	if err != nil {
+		// the ids were not minted after all
+		return result, err
+	}
+
+	return append(result, minted...), nil
+}
+
+// mint returns up to count ids, taking them from the recycle queue first,
+// and then from the counter. Returns true if the state of p changed.
+// expects the caller to be holding the lock on p
+func (p *pool) mint(count int) ([]string, bool) {
+	var result []string = make([]string, 0, count)
+	var changed = false
+
+	for count > 0 && len(p.recycled) > 0 {
+		id := p.recycled[0]
+		p.recycled = p.recycled[1:]
+		changed = true
+		// the exclusions may have changed since id was minted
+		if p.exclude != nil && p.exclude.excluded(id) {
+			continue
+		}
+		result = append(result, id)
+		count--
 	}
 
-	for ; count > 0; count-- {
+	var skips = 0
+	for count > 0 {
+		if p.leased != nil {
+			position, _ := p.noid.Count()
+			if position.Cmp(p.leased) >= 0 {
+				p.lease()
+				changed = true
+			}
+		}
 		id := p.noid.Mint()
 		if id == "" {
 			p.empty = true
 			p.closed = true
 			break
 		}
+		if p.leased == nil {
+			changed = true
+		}
+		if p.exclude != nil && p.exclude.excluded(id) {
+			log.Println("Skipping excluded id", id)
+			p.skipped++
+			skips++
+			if skips >= maxSkips {
+				log.Printf("Pool %s skipped %d excluded ids in a row", p.name, skips)
+				break
+			}
+			continue
+		}
+		skips = 0
 		result = append(result, id)
+		count--
 	}
+	return result, changed
+}
 
-	if len(result) > 0 {
-		p.lastMint = time.Now()
-		pi := PoolInfo{Name: name}
-		copyPoolInfo(&pi, p)
-		err = p.store.SavePool(p.name, pi)
+// lease takes the next block of ids, which starts at the current position
+// or at the end of the last block recorded in the store, whichever is
+// later. The pool must be saved before any of the ids are handed out.
+// expects the caller to be holding the lock on p
+func (p *pool) lease() {
+	start, max := p.noid.Count()
+	if p.stored.Cmp(start) > 0 {
+		// another server leased the ids in between
+		start.Set(p.stored)
+		p.noid.AdvanceTo(start)
+	}
+	end := new(big.Int).Add(start, big.NewInt(p.blockSize))
+	if max.Sign() >= 0 && end.Cmp(max) > 0 {
+		end = max
 	}
+	p.leased = end
+	p.stored = new(big.Int).Set(end)
+}
 
-	return result, err
+// setBlockSize changes the number of ids p leases at a time.
+// expects the caller to be holding the lock on p
+func (p *pool) setBlockSize(n int64) {
+	if n > 0 && p.leased == nil {
+		// nothing is leased until the next mint
+		p.leased, _ = p.noid.Count()
+		p.stored = new(big.Int).Set(p.leased)
+	} else if n == 0 && p.leased != nil {
+		// skip the rest of the lease, so the position in the
+		// store never goes backwards
+		p.noid.AdvanceTo(p.stored)
+		p.leased = nil
+		p.stored = nil
+	}
+	p.blockSize = n
 }
 
 // Ensure that pool named will never mint the given id.
-// Returns the updated pool info
+// Returns the updated pool info. If the id could never be minted by
+// the pool, the error is a *noid.IdError giving the reason.
 func (pg *poolGroup) PoolAdvancePast(name, id string) (PoolInfo, error) {
 	pi := PoolInfo{Name: name}
 	p, err := pg.lookupPool(name)
@@ -192,24 +1124,39 @@ func (pg *poolGroup) PoolAdvancePast(name, id string) (PoolInfo, error) {
 	p.Lock()
 	defer p.Unlock()
 
-	var needSave = false
-	index := p.noid.Index(id)
+	if p.deleted {
+		return pi, NoSuchPool
+	}
+	index, err := p.noid.Validate(id)
 	log.Printf("Index(%v) = %v\n", id, index)
-	if index == -1 {
+	if err != nil {
 		copyPoolInfo(&pi, p)
-		return pi, InvalidId
+		return pi, err
 	}
-	position, _ := p.noid.Count()
-	if index >= position {
-		p.noid.AdvanceTo(index + 1)
+	err = p.update(func() (bool, error) {
+		position, _ := p.noid.Count()
+		next := new(big.Int).Add(index, big.NewInt(1))
+		changed := false
+		if p.shared != nil && (p.advancedTo == nil || next.Cmp(p.advancedTo) > 0) {
+			// another server may have the id in the block it leased
+			p.advancedTo = next
+			changed = true
+		}
+		if index.Cmp(position) < 0 {
+			return changed, nil
+		}
+		p.noid.AdvanceTo(next)
+		if p.leased != nil && next.Cmp(p.leased) > 0 {
+			p.leased = next
+		}
+		if p.stored != nil && next.Cmp(p.stored) > 0 {
+			p.stored = new(big.Int).Set(next)
+		}
 		p.lastMint = time.Now()
-		needSave = true
-	}
+		return true, nil
+	})
 
 	copyPoolInfo(&pi, p)
-	if needSave {
-		err = p.store.SavePool(p.name, pi)
-	}
 	return pi, err
 }
 
@@ -222,42 +1169,183 @@ func (pg *poolGroup) loadFromInfo(pi *PoolInfo) error {
 	if ok {
 		return NameExists
 	}
-	noid, err := noid.NewNoid(pi.Template)
+	if _, ok := pg.tombs[pi.Name]; ok {
+		return NameUsed
+	}
+	noid, err := noid.NewNoidOptions(pi.Template, noid.Options{
+		NAAN:     pi.NAAN,
+		Shoulder: pi.Shoulder,
+		Key:      pi.Key,
+	})
+	if err != nil {
+		return err
+	}
+	exclude, err := newExclusionFilter(pi.Exclusions)
 	if err != nil {
 		return err
 	}
+	if exclude == nil {
+		pi.Exclusions = nil
+	}
+	if pi.BlockSize < 0 {
+		return BadBlockSize
+	}
+	shared, _ := DefaultStore.(SharedStore)
 	p := &pool{
 		noid:     noid,
 		name:     pi.Name,
 		closed:   pi.Closed,
+		created:  pi.Created,
 		lastMint: pi.LastMint,
+		naan:     pi.NAAN,
+		shoulder: pi.Shoulder,
+		key:      pi.Key,
 		store:    DefaultStore,
+		shared:   shared,
+		degraded: pi.Degraded,
+
+		advancedTo: pi.AdvancedTo,
+
+		description: pi.Description,
+		owner:       pi.Owner,
+		tags:        copyTags(pi.Tags),
+		exclusions:  pi.Exclusions,
+		exclude:     exclude,
+		skipped:     pi.Skipped,
+
+		recycled: pi.Recycled,
+	}
+	p.saved = sync.NewCond(&p.Mutex)
+	// nothing is leased until the next mint
+	p.setBlockSize(pi.BlockSize)
+	for _, r := range pi.Reservations {
+		if p.reservations == nil {
+			p.reservations = make(map[string]Reservation)
+		}
+		p.reservations[r.Token] = r
+	}
+	for _, rec := range pi.MintRecords {
+		if p.mintRecords == nil {
+			p.mintRecords = make(map[string]MintRecord)
+		}
+		p.mintRecords[rec.Key] = rec
 	}
+	p.pruneMintRecords()
 	// don't technically hold the lock for p, but it hasn't been inserted into pools, yet
 	copyPoolInfo(pi, p)
-	p.empty = pi.Used == pi.Max
+	if pi.Max.Sign() < 0 || pi.Max.Cmp(maxExactJSON) > 0 {
+		log.Printf("Warning: pool %s has more than 2**53 ids. Clients reading Used and Max as floating point numbers will lose precision", pi.Name)
+	}
+	p.empty = pi.Used.Cmp(pi.Max) == 0
 	pg.table[pi.Name] = p
 	pg.names = append(pg.names, pi.Name)
 	return nil
 }
 
+// LoadPoolsFromStore loads every pool saved in ps. Pools which cannot be
+// loaded are skipped, and quarantined if ps is a Quarantiner, so that the
+// others may still be used. The skipped pools are listed by Skipped().
 func (pg *poolGroup) LoadPoolsFromStore(ps PoolStore) error {
+	tombs, err := ps.LoadAllTombstones()
+	var skipped SkippedRecords
+	if errors.As(err, &skipped) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	pg.LoadTombstones(tombs)
 	pis, err := ps.LoadAllPools()
+	var unread SkippedRecords
+	if errors.As(err, &unread) {
+		err = nil
+		skipped = append(skipped, unread...)
+	}
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
-	return pg.LoadPools(pis)
+	err = pg.LoadPools(pis)
+	var invalid SkippedRecords
+	if errors.As(err, &invalid) {
+		err = nil
+		q, _ := ps.(Quarantiner)
+		for i := range invalid {
+			pg.RLock()
+			_, loaded := pg.table[invalid[i].Name]
+			pg.RUnlock()
+			// a duplicate of a loaded pool has the same record
+			if q == nil || loaded {
+				continue
+			}
+			invalid[i].Quarantine, err = q.Quarantine(invalid[i].Name)
+			if err != nil {
+				log.Printf("Error quarantining %s: %s", invalid[i].Name, err.Error())
+				err = nil
+			}
+		}
+		skipped = append(skipped, invalid...)
+	}
+	for _, rec := range skipped {
+		if rec.Tombstone {
+			log.Printf("Skipped the tombstone of pool %s: %s", rec.Name, rec.Error)
+		} else {
+			log.Printf("Skipped pool %s: %s", rec.Name, rec.Error)
+		}
+	}
+	pg.Lock()
+	pg.skipped = append(pg.skipped, skipped...)
+	pg.Unlock()
+	return err
+}
+
+// Skipped returns the saved pools which could not be loaded.
+func (pg *poolGroup) Skipped() []SkippedRecord {
+	pg.RLock()
+	defer pg.RUnlock()
+	return append([]SkippedRecord(nil), pg.skipped...)
+}
+
+// DegradedPools returns the names of the pools whose last save failed.
+func (pg *poolGroup) DegradedPools() []string {
+	pg.RLock()
+	var ps []*pool
+	for _, name := range pg.names {
+		ps = append(ps, pg.table[name])
+	}
+	pg.RUnlock()
+	var result []string
+	for _, p := range ps {
+		p.Lock()
+		if p.degraded {
+			result = append(result, p.name)
+		}
+		p.Unlock()
+	}
+	return result
+}
+
+func (pg *poolGroup) LoadTombstones(tombs []Tombstone) {
+	pg.Lock()
+	defer pg.Unlock()
+	for _, tomb := range tombs {
+		pg.tombs[tomb.Name] = tomb
+	}
 }
 
+// LoadPools loads the given pools. Any which are invalid, such as having
+// a bad template, are skipped and returned in a SkippedRecords error.
 func (pg *poolGroup) LoadPools(pis []PoolInfo) error {
+	var skipped SkippedRecords
 	for i := range pis {
 		log.Println("Loading", pis[i].Name)
 		err := pg.loadFromInfo(&pis[i])
 		if err != nil {
 			log.Println(err)
-			return err
+			skipped = append(skipped, SkippedRecord{Name: pis[i].Name, Error: err.Error()})
 		}
 	}
+	if len(skipped) > 0 {
+		return skipped
+	}
 	return nil
 }
@@ -1,7 +1,18 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/ndlib/noids/noid"
 )
 
 func TestEverything(t *testing.T) {
@@ -12,8 +23,8 @@ func TestEverything(t *testing.T) {
 	}
 	if pi.Name != "a" ||
 		pi.Template != "something.seeddee+0" ||
-		pi.Used != 0 ||
-		pi.Max != 70728100 ||
+		pi.Used.Sign() != 0 ||
+		pi.Max.Int64() != 70728100 ||
 		pi.Closed != false {
 		t.Errorf("%v does not match expected\n", pi)
 	}
@@ -25,6 +36,22 @@ func TestEverything(t *testing.T) {
 
 }
 
+func TestPoolNames(t *testing.T) {
+	pg := NewPoolGroup()
+	for _, name := range []string{"", ".", "..", "a/b", "a b", "a\tb", "a\x00b", "\xff", strings.Repeat("a", 256)} {
+		_, err := pg.AddPool(name, ".sd")
+		if err != BadPoolName {
+			t.Errorf("%q: expected BadPoolName, got %v", name, err)
+		}
+	}
+	for _, name := range []string{"a", "a.b", "a_b", "a..b", "é", strings.Repeat("a", 255)} {
+		_, err := pg.AddPool(name, ".sd")
+		if err != nil {
+			t.Errorf("%q: got %v", name, err)
+		}
+	}
+}
+
 func TestMint(t *testing.T) {
 	pg := NewPoolGroup()
 	_, err := pg.AddPool("mint", ".sd")
@@ -58,3 +85,688 @@ func TestMint(t *testing.T) {
 		}
 	}
 }
+
+func TestLargePool(t *testing.T) {
+	pg := NewPoolGroup()
+	pi, err := pg.AddPool("large", ".seeeeeeeeeeeee+10260628712958602187")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if pi.Max.String() != "10260628712958602189" {
+		t.Errorf("Max = %v\n", pi.Max)
+	}
+	result, err := pg.PoolMint("large", 5)
+	if err != nil {
+		t.Errorf("%v\n", err)
+	}
+	if len(result) != 2 || result[1] != "zzzzzzzzzzzzz" {
+		t.Errorf("Got %v\n", result)
+	}
+	pi, _ = pg.GetPool("large")
+	if !pi.Closed || pi.Used.Cmp(pi.Max) != 0 {
+		t.Errorf("%v is not exhausted\n", pi)
+	}
+
+	_, err = pg.AddPool("toolarge", ".sdd+200")
+	if err == nil {
+		t.Errorf("Expected error for position past the maximum\n")
+	}
+}
+
+func TestKeyedPool(t *testing.T) {
+	DefaultStore = NewJsonFileStore(t.TempDir())
+	defer func() { DefaultStore = NullStore{} }()
+
+	pg := NewPoolGroup()
+	pi, err := pg.AddPool("keyed", ".ueedk")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if pi.Key != nil {
+		t.Errorf("Key was returned in the pool info\n")
+	}
+	first, _ := pg.PoolMint("keyed", 5)
+
+	// the key is saved with the pool, so a reloaded pool mints the same ids
+	pg2 := NewPoolGroup()
+	err = pg2.LoadPoolsFromStore(DefaultStore)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	next, _ := pg.PoolMint("keyed", 1)
+	next2, _ := pg2.PoolMint("keyed", 1)
+	if len(next) != 1 || len(next2) != 1 || next[0] != next2[0] {
+		t.Errorf("%v != %v\n", next, next2)
+	}
+	pi, _ = pg2.GetPool("keyed")
+	if pi.Key != nil {
+		t.Errorf("Key was returned in the pool info\n")
+	}
+
+	// a different key gives different ids
+	pg.AddPool("keyed2", ".ueedk")
+	other, _ := pg.PoolMint("keyed2", 5)
+	if strings.Join(other, ",") == strings.Join(first, ",") {
+		t.Errorf("Two keyed pools minted the same ids %v\n", first)
+	}
+}
+
+func TestDeletePool(t *testing.T) {
+	DefaultStore = NewJsonFileStore(t.TempDir())
+	defer func() { DefaultStore = NullStore{} }()
+
+	pg := NewPoolGroup()
+	pg.AddPool("doomed", ".sddd")
+	pg.AddPool("other", ".sddd")
+	pg.PoolMint("doomed", 5)
+
+	_, err := pg.DeletePool("doomed")
+	if err != PoolOpen {
+		t.Errorf("Expected PoolOpen, got %v\n", err)
+	}
+	pg.SetPoolState("doomed", true)
+	tomb, err := pg.DeletePool("doomed")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if tomb.Name != "doomed" || tomb.Template != ".sddd+5" {
+		t.Errorf("Got %v\n", tomb)
+	}
+	_, err = pg.GetPool("doomed")
+	if err != NoSuchPool {
+		t.Errorf("Expected NoSuchPool, got %v\n", err)
+	}
+	if names := pg.AllPools(); len(names) != 1 || names[0] != "other" {
+		t.Errorf("Got %v\n", names)
+	}
+	_, err = pg.AddPool("doomed", ".sddd")
+	if err != NameUsed {
+		t.Errorf("Expected NameUsed, got %v\n", err)
+	}
+
+	// the tombstone is kept by the store
+	pg2 := NewPoolGroup()
+	err = pg2.LoadPoolsFromStore(DefaultStore)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if names := pg2.AllPools(); len(names) != 1 || names[0] != "other" {
+		t.Errorf("Got %v\n", names)
+	}
+	tombs := pg2.AllTombstones()
+	if len(tombs) != 1 || tombs[0].Template != ".sddd+5" {
+		t.Errorf("Got %v\n", tombs)
+	}
+	_, err = pg2.AddPool("doomed", ".sddd")
+	if err != NameUsed {
+		t.Errorf("Expected NameUsed, got %v\n", err)
+	}
+}
+
+func TestPoolMetadata(t *testing.T) {
+	DefaultStore = NewJsonFileStore(t.TempDir())
+	defer func() { DefaultStore = NullStore{} }()
+
+	pg := NewPoolGroup()
+	pi, err := pg.CreatePool(PoolInfo{
+		Name:        "described",
+		Template:    ".sddd",
+		Description: "item ids",
+		Owner:       "library",
+		Tags:        map[string]string{"project": "curate"},
+	})
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if pi.Created.IsZero() || pi.Description != "item ids" || pi.Tags["project"] != "curate" {
+		t.Errorf("Got %v\n", pi)
+	}
+
+	owner := "archives"
+	pi, err = pg.UpdatePool("described", PoolUpdate{
+		Owner: &owner,
+		Tags:  map[string]string{"project": "", "env": "prod"},
+	})
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if pi.Owner != "archives" || pi.Description != "item ids" || len(pi.Tags) != 1 || pi.Tags["env"] != "prod" {
+		t.Errorf("Got %v\n", pi)
+	}
+
+	pg2 := NewPoolGroup()
+	err = pg2.LoadPoolsFromStore(DefaultStore)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	pi2, _ := pg2.GetPool("described")
+	if !pi2.Created.Equal(pi.Created) || pi2.Owner != "archives" || pi2.Tags["env"] != "prod" {
+		t.Errorf("Got %v\n", pi2)
+	}
+}
+
+func TestExcludedIds(t *testing.T) {
+	DefaultStore = NewJsonFileStore(t.TempDir())
+	defer func() { DefaultStore = NullStore{} }()
+
+	pg := NewPoolGroup()
+	_, err := pg.CreatePool(PoolInfo{
+		Name:       "picky",
+		Template:   ".sd",
+		Exclusions: &Exclusions{Ids: []string{"1", "3"}, Patterns: []string{"[57]"}},
+	})
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	result, err := pg.PoolMint("picky", 5)
+	if err != nil {
+		t.Errorf("%v\n", err)
+	}
+	if strings.Join(result, ",") != "0,2,4,6,8" {
+		t.Errorf("Got %v\n", result)
+	}
+	pi, _ := pg.GetPool("picky")
+	if pi.Skipped != 4 || pi.Used.Int64() != 9 {
+		t.Errorf("Got %v\n", pi)
+	}
+
+	// the exclusions and skip count are saved
+	pg2 := NewPoolGroup()
+	err = pg2.LoadPoolsFromStore(DefaultStore)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	pi, _ = pg2.GetPool("picky")
+	if pi.Skipped != 4 || len(pi.Exclusions.Patterns) != 1 {
+		t.Errorf("Got %v\n", pi)
+	}
+
+	// excluding everything empties the pool
+	pg.AddPool("nothing", ".sdd")
+	pi, err = pg.UpdatePool("nothing", PoolUpdate{Exclusions: &Exclusions{Patterns: []string{"."}}})
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	result, _ = pg.PoolMint("nothing", 1)
+	pi, _ = pg.GetPool("nothing")
+	if len(result) != 0 || !pi.Closed || pi.Skipped != 100 {
+		t.Errorf("Got %v, %v\n", result, pi)
+	}
+}
+
+func TestBindings(t *testing.T) {
+	DefaultStore = NewJsonFileStore(t.TempDir())
+	defer func() { DefaultStore = NullStore{} }()
+
+	pg := NewPoolGroup()
+	pg.AddPool("bound", ".sdk")
+	pg.PoolMint("bound", 3)
+
+	b, err := pg.SetBindings("bound", "00", map[string]string{"pid": "und:1234", "title": "A"})
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if len(b) != 2 || b["pid"] != "und:1234" {
+		t.Errorf("Got %v\n", b)
+	}
+	_, err = pg.SetBindings("bound", "55", map[string]string{"title": "B"})
+	if err != NotMinted {
+		t.Errorf("Expected NotMinted, got %v\n", err)
+	}
+	_, err = pg.GetBindings("bound", "01")
+	if _, ok := err.(*noid.IdError); !ok {
+		t.Errorf("Expected IdError, got %v\n", err)
+	}
+
+	// bindings are read back from the store
+	pg2 := NewPoolGroup()
+	pg2.LoadPoolsFromStore(DefaultStore)
+	b, err = pg2.GetBindings("bound", "00")
+	if err != nil || b["title"] != "A" {
+		t.Errorf("Got %v, %v\n", b, err)
+	}
+	pg2.SetBindings("bound", "00", map[string]string{"pid": "", "title": ""})
+	b, _ = pg2.GetBindings("bound", "00")
+	if len(b) != 0 {
+		t.Errorf("Got %v\n", b)
+	}
+}
+
+func TestReservations(t *testing.T) {
+	DefaultStore = NewJsonFileStore(t.TempDir())
+	defer func() { DefaultStore = NullStore{} }()
+
+	pg := NewPoolGroup()
+	pg.AddPool("held", ".sd")
+	r1, err := pg.PoolReserve("held", 3, time.Hour)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	r2, _ := pg.PoolReserve("held", 2, time.Hour)
+	if strings.Join(r1.Ids, ",") != "0,1,2" || strings.Join(r2.Ids, ",") != "3,4" || r1.Token == r2.Token {
+		t.Errorf("Got %v and %v\n", r1, r2)
+	}
+
+	ids, err := pg.CommitReservation("held", r1.Token, []string{"0"})
+	if err != nil || len(ids) != 1 {
+		t.Errorf("Got %v, %v\n", ids, err)
+	}
+	_, err = pg.ReleaseReservation("held", r1.Token, []string{"3"})
+	if err != NotReserved {
+		t.Errorf("Expected NotReserved, got %v\n", err)
+	}
+	ids, _ = pg.ReleaseReservation("held", r1.Token, nil)
+	if strings.Join(ids, ",") != "1,2" {
+		t.Errorf("Got %v\n", ids)
+	}
+	_, err = pg.CommitReservation("held", r1.Token, nil)
+	if err != NoSuchReservation {
+		t.Errorf("Expected NoSuchReservation, got %v\n", err)
+	}
+
+	// released ids are handed out before new ones
+	ids, _ = pg.PoolMint("held", 3)
+	if strings.Join(ids, ",") != "1,2,5" {
+		t.Errorf("Got %v\n", ids)
+	}
+
+	// an expired reservation is recycled
+	pg.PoolReserve("held", 1, 0)
+	pi, _ := pg.GetPool("held")
+	// without the token, which only the client which reserved the ids has
+	if len(pi.Reservations) != 1 || pi.Reservations[0].Token != "" || strings.Join(pi.Reservations[0].Ids, ",") != "3,4" || strings.Join(pi.Recycled, ",") != "6" {
+		t.Errorf("Got %v\n", pi)
+	}
+
+	// reservations survive a restart
+	pg2 := NewPoolGroup()
+	err = pg2.LoadPoolsFromStore(DefaultStore)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	ids, err = pg2.CommitReservation("held", r2.Token, nil)
+	if err != nil || strings.Join(ids, ",") != "3,4" {
+		t.Errorf("Got %v, %v\n", ids, err)
+	}
+	ids, _ = pg2.PoolMint("held", 2)
+	if strings.Join(ids, ",") != "6,7" {
+		t.Errorf("Got %v\n", ids)
+	}
+
+	// the number of reserved ids is limited
+	defer func(n int) { MaxReservedIds = n }(MaxReservedIds)
+	MaxReservedIds = 5
+	pg2.AddPool("limited", ".zd")
+	_, err = pg2.PoolReserve("limited", 4, time.Hour)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	_, err = pg2.PoolReserve("limited", 2, time.Hour)
+	if err != TooManyReserved {
+		t.Errorf("Expected TooManyReserved, got %v\n", err)
+	}
+}
+
+func TestIdempotentMint(t *testing.T) {
+	DefaultStore = NewJsonFileStore(t.TempDir())
+	defer func() { DefaultStore = NullStore{} }()
+
+	pg := NewPoolGroup()
+	pg.AddPool("retry", ".sdd")
+	first, err := pg.PoolMintKey("retry", "abc", 3)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	again, _ := pg.PoolMintKey("retry", "abc", 3)
+	if strings.Join(again, ",") != strings.Join(first, ",") {
+		t.Errorf("%v != %v\n", again, first)
+	}
+	_, err = pg.PoolMintKey("retry", "abc", 4)
+	if err != KeyReused {
+		t.Errorf("Expected KeyReused, got %v\n", err)
+	}
+	pi, _ := pg.GetPool("retry")
+	if pi.Used.Int64() != 3 || pi.MintRecords != nil {
+		t.Errorf("Got %v\n", pi)
+	}
+
+	// the keys are saved with the pool
+	pg2 := NewPoolGroup()
+	pg2.LoadPoolsFromStore(DefaultStore)
+	again, _ = pg2.PoolMintKey("retry", "abc", 3)
+	if strings.Join(again, ",") != strings.Join(first, ",") {
+		t.Errorf("%v != %v\n", again, first)
+	}
+
+	// and forgotten after the window
+	defer func(w time.Duration) { IdempotencyWindow = w }(IdempotencyWindow)
+	IdempotencyWindow = 0
+	again, _ = pg2.PoolMintKey("retry", "abc", 3)
+	if strings.Join(again, ",") != "03,04,05" {
+		t.Errorf("Got %v\n", again)
+	}
+}
+
+// failStore is a PoolStore whose saves fail while fail is set
+type failStore struct {
+	NullStore
+	fail bool
+}
+
+func (fs *failStore) SavePool(name string, pi PoolInfo) error {
+	if fs.fail {
+		return errors.New("disk full")
+	}
+	return nil
+}
+
+func TestSaveFailure(t *testing.T) {
+	store := &failStore{}
+	DefaultStore = store
+	defer func() { DefaultStore = NullStore{} }()
+
+	pg := NewPoolGroup()
+	pg.AddPool("fragile", ".sdd")
+	pg.PoolMint("fragile", 2)
+
+	store.fail = true
+	_, err := pg.AddPool("new", ".sdd")
+	if _, ok := err.(*StoreError); !ok {
+		t.Errorf("Expected StoreError, got %v\n", err)
+	}
+	if _, err = pg.GetPool("new"); err != NoSuchPool {
+		t.Errorf("Pool was created without being saved\n")
+	}
+	ids, err := pg.PoolMint("fragile", 3)
+	if _, ok := err.(*StoreError); !ok || len(ids) != 0 {
+		t.Errorf("Got %v, %v\n", ids, err)
+	}
+	_, err = pg.PoolAdvancePast("fragile", "50")
+	if _, ok := err.(*StoreError); !ok {
+		t.Errorf("Expected StoreError, got %v\n", err)
+	}
+	pi, err := pg.SetPoolState("fragile", true)
+	if _, ok := err.(*StoreError); !ok {
+		t.Errorf("Expected StoreError, got %v\n", err)
+	}
+	if pi.Used.Int64() != 2 || pi.Closed || !pi.Degraded {
+		t.Errorf("Got %v\n", pi)
+	}
+
+	// once the store works, the pool carries on where it was
+	store.fail = false
+	ids, err = pg.PoolMint("fragile", 1)
+	if err != nil || len(ids) != 1 || ids[0] != "02" {
+		t.Errorf("Got %v, %v\n", ids, err)
+	}
+	pi, _ = pg.GetPool("fragile")
+	if pi.Degraded {
+		t.Errorf("Pool is still degraded\n")
+	}
+}
+
+// countStore is a PoolStore which remembers the last pool saved
+type countStore struct {
+	NullStore
+	saves int
+	last  PoolInfo
+}
+
+func (cs *countStore) SavePool(name string, pi PoolInfo) error {
+	cs.saves++
+	cs.last = pi
+	return nil
+}
+
+func TestBlockLeasing(t *testing.T) {
+	store := &countStore{}
+	DefaultStore = store
+	defer func() { DefaultStore = NullStore{} }()
+
+	pg := NewPoolGroup()
+	_, err := pg.CreatePool(PoolInfo{Name: "test", Template: ".sddd", BlockSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	mint := func(count int) {
+		ids, err := pg.PoolMint("test", count)
+		if err != nil || len(ids) != count {
+			t.Fatalf("Got %v, %v", ids, err)
+		}
+		for _, id := range ids {
+			if seen[id] {
+				t.Errorf("%s was minted twice", id)
+			}
+			seen[id] = true
+		}
+	}
+
+	mint(1)
+	if store.saves != 2 || store.last.Used.Int64() != 10 || store.last.Template != ".sddd+10" {
+		t.Errorf("Expected the lease to be saved, got %d saves, %v", store.saves, store.last)
+	}
+	mint(8)
+	if store.saves != 2 {
+		t.Errorf("Expected no saves inside the lease, got %d", store.saves)
+	}
+	pi, _ := pg.GetPool("test")
+	if pi.Used.Int64() != 9 || pi.Leased.Int64() != 10 {
+		t.Errorf("Got Used %v, Leased %v", pi.Used, pi.Leased)
+	}
+	mint(2)
+	if store.saves != 3 || store.last.Used.Int64() != 20 {
+		t.Errorf("Expected a second lease, got %d saves, %v", store.saves, store.last)
+	}
+
+	// a restart loses the rest of the block, and mints no duplicates
+	pg = NewPoolGroup()
+	pg.LoadPools([]PoolInfo{store.last})
+	pi, _ = pg.GetPool("test")
+	if pi.Used.Int64() != 20 || pi.BlockSize != 10 {
+		t.Errorf("Got %v", pi)
+	}
+	mint(15)
+	if store.last.Used.Int64() != 40 {
+		t.Errorf("Expected a lease to 40, got %v", store.last.Used)
+	}
+
+	// turning leasing off skips the rest of the block
+	var zero int64
+	pi, err = pg.UpdatePool("test", PoolUpdate{BlockSize: &zero})
+	if err != nil || pi.Used.Int64() != 40 || pi.Leased != nil {
+		t.Errorf("Got %v, %v", pi, err)
+	}
+	mint(1)
+	if store.last.Used.Int64() != 41 {
+		t.Errorf("Expected every mint to be saved, got %v", store.last.Used)
+	}
+
+	var negative int64 = -1
+	_, err = pg.UpdatePool("test", PoolUpdate{BlockSize: &negative})
+	if err != BadBlockSize {
+		t.Errorf("Expected BadBlockSize, got %v", err)
+	}
+}
+
+// gateStore is a PoolStore whose saves wait until they are let through
+type gateStore struct {
+	NullStore
+	sync.Mutex
+	saves   int
+	fail    bool
+	entered chan bool
+	gate    chan bool
+}
+
+func (gs *gateStore) SavePool(name string, pi PoolInfo) error {
+	gs.entered <- true
+	<-gs.gate
+	gs.Lock()
+	defer gs.Unlock()
+	gs.saves++
+	if gs.fail {
+		return errors.New("disk full")
+	}
+	return nil
+}
+
+func TestGroupCommit(t *testing.T) {
+	store := &gateStore{entered: make(chan bool, 100), gate: make(chan bool, 100)}
+	DefaultStore = store
+	defer func() { DefaultStore = NullStore{} }()
+
+	pg := NewPoolGroup()
+	store.gate <- true
+	pg.AddPool("test", ".sddd")
+	<-store.entered
+
+	// mint once to hold up the store, then mint many times while
+	// the first save is waiting
+	mint := func(errs chan error) {
+		_, err := pg.PoolMint("test", 1)
+		errs <- err
+	}
+	errs := make(chan error, 20)
+	go mint(errs)
+	<-store.entered
+	for i := 0; i < 19; i++ {
+		go mint(errs)
+	}
+	waitForUsed(t, pg, 20)
+	store.gate <- true
+	<-store.entered
+	store.gate <- true
+	for i := 0; i < 20; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if store.saves != 3 {
+		t.Errorf("Expected 3 saves, got %d", store.saves)
+	}
+
+	// a failed save undoes the changes waiting for the next save too
+	go mint(errs)
+	<-store.entered
+	go mint(errs)
+	waitForUsed(t, pg, 22)
+	store.Lock()
+	store.fail = true
+	store.Unlock()
+	store.gate <- true
+	for i := 0; i < 2; i++ {
+		if _, ok := (<-errs).(*StoreError); !ok {
+			t.Errorf("Expected StoreError")
+		}
+	}
+	pi, _ := pg.GetPool("test")
+	if pi.Used.Int64() != 20 || !pi.Degraded {
+		t.Errorf("Got %v", pi)
+	}
+}
+
+func TestGroupCommitLease(t *testing.T) {
+	store := &gateStore{entered: make(chan bool, 100), gate: make(chan bool, 100)}
+	DefaultStore = store
+	defer func() { DefaultStore = NullStore{} }()
+
+	pg := NewPoolGroup()
+	store.gate <- true
+	pg.CreatePool(PoolInfo{Name: "test", Template: ".sddd", BlockSize: 10})
+	<-store.entered
+
+	// the first mint takes a lease, and the second is covered by it
+	// while the lease is being saved
+	type result struct {
+		ids []string
+		err error
+	}
+	results := make(chan result, 2)
+	mint := func() {
+		ids, err := pg.PoolMint("test", 1)
+		results <- result{ids, err}
+	}
+	go mint()
+	<-store.entered
+	go mint()
+	waitForUsed(t, pg, 2)
+	select {
+	case r := <-results:
+		t.Fatalf("Got %v before the lease was saved", r)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// if the lease is not saved, neither mint may hand out its id
+	store.Lock()
+	store.fail = true
+	store.Unlock()
+	store.gate <- true
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if _, ok := r.err.(*StoreError); !ok {
+			t.Errorf("Expected StoreError, got %v", r)
+		}
+	}
+}
+
+// waitForUsed waits until the pool test has minted n ids
+func waitForUsed(t *testing.T, pg *poolGroup, n int64) {
+	for i := 0; i < 1000; i++ {
+		pi, _ := pg.GetPool("test")
+		if pi.Used.Int64() == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("pool never reached %d ids", n)
+}
+
+// benchmarkMint mints one id at a time from one pool, from many goroutines
+func benchmarkMint(b *testing.B, store PoolStore) {
+	DefaultStore = store
+	log.SetOutput(io.Discard)
+	defer func() {
+		DefaultStore = NullStore{}
+		log.SetOutput(os.Stderr)
+	}()
+
+	pg := NewPoolGroup()
+	_, err := pg.AddPool("hot", ".zd")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, err := pg.PoolMint("hot", 1)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkMintJSONStore(b *testing.B) {
+	benchmarkMint(b, NewJsonFileStore(b.TempDir()))
+}
+
+func BenchmarkMintSqliteStore(b *testing.B) {
+	db, err := sql.Open("sqlite3", filepath.Join(b.TempDir(), "noids.db"))
+	if err != nil {
+		b.Skip(err)
+	}
+	defer db.Close()
+	benchmarkMint(b, NewDbFileStore(db))
+}
+
+func BenchmarkMintBoltStore(b *testing.B) {
+	store, err := NewBoltStore(filepath.Join(b.TempDir(), "noids.bolt"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.(*boltStore).Close()
+	benchmarkMint(b, store)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"time"
+)
+
+// A Reservation holds ids which have been handed out by a pool, but
+// which the client has not yet committed to using. Ids which are released,
+// or which are still reserved when the reservation expires, are put on the
+// pool's recycle queue and will be handed out again.
+type Reservation struct {
+	Token   string `json:",omitempty"`
+	Ids     []string
+	Expires time.Time
+}
+
+var (
+	NoSuchReservation = errors.New("Reservation could not be found")
+	NotReserved       = errors.New("Id is not part of the reservation")
+	TooManyReserved   = errors.New("Pool has too many reserved ids")
+
+	// the longest a reservation may last
+	MaxReservationTTL = 7 * 24 * time.Hour
+
+	// the most ids a pool may hold in reservations and on its recycle
+	// queue, which are saved with the pool
+	MaxReservedIds = 100000
+)
+
+// newToken returns a random string to identify a reservation.
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// copyReservations returns the reservations of p sorted by expiration.
+// expects the caller to be holding the lock on p
+func copyReservations(p *pool) []Reservation {
+	if len(p.reservations) == 0 {
+		return nil
+	}
+	result := make([]Reservation, 0, len(p.reservations))
+	for _, r := range p.reservations {
+		r.Ids = append([]string(nil), r.Ids...)
+		result = append(result, r)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Expires.Equal(result[j].Expires) {
+			return result[i].Token < result[j].Token
+		}
+		return result[i].Expires.Before(result[j].Expires)
+	})
+	return result
+}
+
+// expireReservations moves the ids of every expired reservation onto the
+// recycle queue. Returns true if anything expired.
+// expects the caller to be holding the lock on p
+func (p *pool) expireReservations() bool {
+	var changed = false
+	now := time.Now()
+	// go through them in order so ids are recycled in a repeatable order
+	for _, r := range copyReservations(p) {
+		if r.Expires.After(now) {
+			break
+		}
+		p.recycled = append(p.recycled, r.Ids...)
+		delete(p.reservations, r.Token)
+		changed = true
+	}
+	return changed
+}
+
+// reservedIds returns the number of ids in reservations and on the
+// recycle queue of p.
+// expects the caller to be holding the lock on p
+func (p *pool) reservedIds() int {
+	n := len(p.recycled)
+	for _, r := range p.reservations {
+		n += len(r.Ids)
+	}
+	return n
+}
+
+// PoolReserve mints up to count ids from the pool named and holds them
+// in a new reservation lasting ttl. As with PoolMint, less ids than
+// requested may be returned.
+func (pg *poolGroup) PoolReserve(name string, count int, ttl time.Duration) (Reservation, error) {
+	var r Reservation
+	p, err := pg.lookupPool(name)
+	if err != nil {
+		return r, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.deleted {
+		return r, NoSuchPool
+	}
+	r.Token, err = newToken()
+	if err != nil {
+		return r, err
+	}
+	r.Expires = time.Now().Add(ttl)
+
+	var ids []string
+	err = p.update(func() (bool, error) {
+		expired := p.expireReservations()
+		if p.closed {
+			return expired, PoolClosed
+		}
+		if p.reservedIds()+count > MaxReservedIds {
+			return expired, TooManyReserved
+		}
+		var changed bool
+		ids, changed = p.mint(count)
+		if len(ids) > 0 {
+			if p.reservations == nil {
+				p.reservations = make(map[string]Reservation)
+			}
+			p.reservations[r.Token] = Reservation{Token: r.Token, Ids: ids, Expires: r.Expires}
+			p.lastMint = time.Now()
+			changed = true
+		}
+		return changed || expired, nil
+	})
+	if err != nil {
+		return r, err
+	}
+	r.Ids = append([]string(nil), ids...)
+	return r, nil
+}
+
+// CommitReservation marks ids of the given reservation as used. If ids is
+// empty, every id in the reservation is committed.
+// Returns the ids committed.
+func (pg *poolGroup) CommitReservation(name, token string, ids []string) ([]string, error) {
+	return pg.finishReservation(name, token, ids, false)
+}
+
+// ReleaseReservation returns ids of the given reservation to the pool,
+// which will hand them out again. If ids is empty, every id in the
+// reservation is released.
+// Returns the ids released.
+func (pg *poolGroup) ReleaseReservation(name, token string, ids []string) ([]string, error) {
+	return pg.finishReservation(name, token, ids, true)
+}
+
+func (pg *poolGroup) finishReservation(name, token string, ids []string, release bool) ([]string, error) {
+	p, err := pg.lookupPool(name)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.deleted {
+		return nil, NoSuchPool
+	}
+	var done []string
+	err = p.update(func() (bool, error) {
+		done = nil
+		expired := p.expireReservations()
+		r, ok := p.reservations[token]
+		if !ok {
+			return expired, NoSuchReservation
+		}
+		var rest []string
+		if len(ids) == 0 {
+			done = r.Ids
+		} else {
+			want := make(map[string]bool)
+			for _, id := range ids {
+				want[id] = true
+			}
+			for _, id := range r.Ids {
+				if want[id] {
+					done = append(done, id)
+					delete(want, id)
+				} else {
+					rest = append(rest, id)
+				}
+			}
+			if len(want) > 0 {
+				done = nil
+				return expired, NotReserved
+			}
+		}
+		if release {
+			p.recycled = append(p.recycled, done...)
+		}
+		if len(rest) == 0 {
+			delete(p.reservations, token)
+		} else {
+			r.Ids = rest
+			p.reservations[token] = r
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return done, nil
+}
@@ -1,5 +1,13 @@
 package main
 
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
 // PoolStore provides a way to change the storage backend.
 type PoolStore interface {
 	// SavePool takes a PoolInfo structure and saves it somehow.
@@ -10,6 +18,121 @@ type PoolStore interface {
 	SavePool(name string, info PoolInfo) error
 
 	// LoadAllPools returns a list of the saved pools, or an error
-	// it all the pools couldn't be read for some reason.
+	// it all the pools couldn't be read for some reason. If only some
+	// of them couldn't be read, the others are returned along with
+	// a SkippedRecords error.
 	LoadAllPools() ([]PoolInfo, error)
+
+	// DeletePool removes the saved pool `name` and saves `tomb` in
+	// its place.
+	DeletePool(name string, tomb Tombstone) error
+
+	// LoadAllTombstones returns a list of the tombstones of every
+	// deleted pool. As with LoadAllPools, tombstones which couldn't be
+	// read are given by a SkippedRecords error.
+	LoadAllTombstones() ([]Tombstone, error)
+
+	// SaveBinding saves the bindings for the id having the given index
+	// in the pool `name`. An empty map removes the id's bindings.
+	SaveBinding(name, index string, b map[string]string) error
+
+	// LoadBinding returns the bindings for the id having the given
+	// index in the pool `name`, or nil if there are none.
+	LoadBinding(name, index string) (map[string]string, error)
+}
+
+// A SharedStore is a PoolStore which several servers may use at the same
+// time. The saved pools are authoritative: a server reloads a pool before
+// changing it, and the change is only saved if no other server has saved
+// the pool in the meantime.
+type SharedStore interface {
+	PoolStore
+
+	// LoadPool returns the saved pool `name` and its version. Returns
+	// NoSuchPool if there is no such pool.
+	LoadPool(name string) (PoolInfo, int64, error)
+
+	// SavePoolVersion saves the pool `name` if its saved version is
+	// `version`, and returns the new version. If the pool was saved by
+	// someone else since it was loaded, VersionConflict is returned.
+	SavePoolVersion(name string, pi PoolInfo, version int64) (int64, error)
+
+	// InsertPool saves a new pool. Returns NameExists if there is already
+	// a pool with the name, and NameUsed if there is a tombstone for it.
+	InsertPool(name string, pi PoolInfo) error
+}
+
+var VersionConflict = errors.New("Pool was changed by another server")
+
+// A SkippedRecord is a saved pool, or tombstone, which could not be loaded.
+type SkippedRecord struct {
+	Name       string // the pool's name, or the file holding it
+	Error      string
+	Quarantine string `json:",omitempty"` // where the record was moved to
+	Tombstone  bool   `json:",omitempty"`
+}
+
+// SkippedRecords is the error returned by LoadAllPools with the pools it
+// could read, when there were others it could not.
+type SkippedRecords []SkippedRecord
+
+func (s SkippedRecords) Error() string {
+	return fmt.Sprintf("%d saved pools could not be loaded", len(s))
+}
+
+// A Quarantiner is a PoolStore which can set aside a saved pool which
+// cannot be loaded, so it is not tried again. Quarantine returns where
+// the pool was moved to.
+type Quarantiner interface {
+	Quarantine(name string) (string, error)
+}
+
+// The mint records of a pool are kept apart from the pool, so that a save
+// only writes the records made since the last one. mintMarks keeps the
+// time of the newest record saved or loaded, by pool.
+type mintMarks struct {
+	sync.Mutex
+	newest map[string]time.Time
+}
+
+// unsaved returns the records in recs which may not have been saved.
+func (m *mintMarks) unsaved(name string, recs []MintRecord) []MintRecord {
+	m.Lock()
+	newest := m.newest[name]
+	m.Unlock()
+	var result []MintRecord
+	for _, rec := range recs {
+		if !rec.Time.Before(newest) {
+			result = append(result, rec)
+		}
+	}
+	return result
+}
+
+// mark notes that recs have been saved.
+func (m *mintMarks) mark(name string, recs []MintRecord) {
+	m.Lock()
+	defer m.Unlock()
+	if m.newest == nil {
+		m.newest = make(map[string]time.Time)
+	}
+	for _, rec := range recs {
+		if rec.Time.After(m.newest[name]) {
+			m.newest[name] = rec.Time
+		}
+	}
+}
+
+// mintRecordName returns the key used to save rec. Keys sort in the order
+// the records were made, and begin with mintRecordCutoff() for records
+// which have not expired.
+func mintRecordName(rec MintRecord) string {
+	hash := sha256.Sum256([]byte(rec.Key))
+	return fmt.Sprintf("%019d.%x", rec.Time.UnixNano(), hash)
+}
+
+// mintRecordCutoff returns the key of a record made as long ago as
+// IdempotencyWindow. Records with earlier keys have expired.
+func mintRecordCutoff() string {
+	return fmt.Sprintf("%019d", time.Now().Add(-IdempotencyWindow).UnixNano())
 }
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltStore keeps pools in a bolt file, an embedded transactional
+// key-value store. Pools and tombstones are JSON values keyed by the
+// pool's name, and each pool's bindings and mint records are kept in a
+// nested bucket. Every change is one transaction, which is synced to the
+// disk.
+type boltStore struct {
+	db    *bolt.DB
+	mints mintMarks
+}
+
+// bolt keeps the file locked while it is open, and the server holding it
+// writes who it is into a file with this suffix, since the bolt file
+// cannot be read by another server.
+const boltHolderSuffix = ".lock"
+
+var (
+	boltPools      = []byte("pools")
+	boltTombstones = []byte("tombstones")
+	boltBindings   = []byte("bindings")
+	boltQuarantine = []byte("quarantine")
+	// a bucket for each pool, holding its mint records by mintRecordName()
+	boltMintRecords = []byte("mintrecords")
+)
+
+// Create a PoolStore which will serialize noid pools in the bolt file
+// fname, which is created if necessary. Only one server may have the
+// file open at a time.
+func NewBoltStore(fname string) (PoolStore, error) {
+	db, err := bolt.Open(fname, 0666, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		holder, _ := os.ReadFile(fname + boltHolderSuffix)
+		return nil, fmt.Errorf("%w: %s", StoreLocked, holder)
+	} else if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(fname+boltHolderSuffix, []byte(lockHolder()), 0666)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltPools, boltTombstones, boltBindings, boltQuarantine, boltMintRecords} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (bs *boltStore) Close() error {
+	os.Remove(bs.db.Path() + boltHolderSuffix)
+	return bs.db.Close()
+}
+
+func (bs *boltStore) SavePool(name string, pi PoolInfo) error {
+	log.Println("Save (bolt)", name)
+	recs := bs.mints.unsaved(name, pi.MintRecords)
+	pi.MintRecords = nil
+	data, err := json.Marshal(pi)
+	if err != nil {
+		return err
+	}
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltPools).Put([]byte(name), data)
+		if err != nil || len(recs) == 0 {
+			return err
+		}
+		bucket, err := tx.Bucket(boltMintRecords).CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			v, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			err = bucket.Put([]byte(mintRecordName(rec)), v)
+			if err != nil {
+				return err
+			}
+		}
+		// remove the expired records
+		var expired [][]byte
+		cutoff := []byte(mintRecordCutoff())
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, cutoff) < 0; k, _ = c.Next() {
+			expired = append(expired, k)
+		}
+		for _, k := range expired {
+			err = bucket.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		bs.mints.mark(name, recs)
+	}
+	return err
+}
+
+func (bs *boltStore) LoadAllPools() ([]PoolInfo, error) {
+	var (
+		pis     []PoolInfo
+		skipped SkippedRecords
+	)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltPools).ForEach(func(k, v []byte) error {
+			var pi PoolInfo
+			err := json.Unmarshal(v, &pi)
+			if err == nil {
+				err = bs.loadMintRecords(tx, &pi)
+			}
+			if err != nil {
+				skipped = append(skipped, SkippedRecord{Name: string(k), Error: err.Error()})
+				return nil
+			}
+			pis = append(pis, pi)
+			return nil
+		})
+	})
+	if err == nil && len(skipped) > 0 {
+		return pis, skipped
+	}
+	return pis, err
+}
+
+// loadMintRecords adds the unexpired mint records of pi to it.
+func (bs *boltStore) loadMintRecords(tx *bolt.Tx, pi *PoolInfo) error {
+	bucket := tx.Bucket(boltMintRecords).Bucket([]byte(pi.Name))
+	if bucket == nil {
+		return nil
+	}
+	var recs []MintRecord
+	c := bucket.Cursor()
+	for k, v := c.Seek([]byte(mintRecordCutoff())); k != nil; k, v = c.Next() {
+		var rec MintRecord
+		err := json.Unmarshal(v, &rec)
+		if err != nil {
+			return err
+		}
+		recs = append(recs, rec)
+	}
+	bs.mints.mark(pi.Name, recs)
+	// pools saved before the records were kept apart have them already
+	pi.MintRecords = append(pi.MintRecords, recs...)
+	return nil
+}
+
+// Quarantine moves the pool `name` into the quarantine bucket, with the
+// time added to its key.
+func (bs *boltStore) Quarantine(name string) (string, error) {
+	key := name + "." + time.Now().UTC().Format("20060102T150405.000000000")
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		pools := tx.Bucket(boltPools)
+		v := pools.Get([]byte(name))
+		if v == nil {
+			return nil
+		}
+		err := tx.Bucket(boltQuarantine).Put([]byte(key), v)
+		if err != nil {
+			return err
+		}
+		return pools.Delete([]byte(name))
+	})
+	return string(boltQuarantine) + "/" + key, err
+}
+
+func (bs *boltStore) DeletePool(name string, tomb Tombstone) error {
+	log.Println("Delete (bolt)", name)
+	data, err := json.Marshal(tomb)
+	if err != nil {
+		return err
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltTombstones).Put([]byte(name), data)
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(boltBindings).DeleteBucket([]byte(name))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		err = tx.Bucket(boltMintRecords).DeleteBucket([]byte(name))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return tx.Bucket(boltPools).Delete([]byte(name))
+	})
+}
+
+func (bs *boltStore) LoadAllTombstones() ([]Tombstone, error) {
+	var (
+		tombs   []Tombstone
+		skipped SkippedRecords
+	)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTombstones).ForEach(func(k, v []byte) error {
+			var tomb Tombstone
+			err := json.Unmarshal(v, &tomb)
+			if err != nil {
+				skipped = append(skipped, SkippedRecord{Name: string(k), Error: err.Error(), Tombstone: true})
+				return nil
+			}
+			tombs = append(tombs, tomb)
+			return nil
+		})
+	})
+	if err == nil && len(skipped) > 0 {
+		return tombs, skipped
+	}
+	return tombs, err
+}
+
+func (bs *boltStore) SaveBinding(name, index string, b map[string]string) error {
+	log.Println("Save binding (bolt)", name, index)
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		if len(b) == 0 {
+			bucket := tx.Bucket(boltBindings).Bucket([]byte(name))
+			if bucket == nil {
+				return nil
+			}
+			return bucket.Delete([]byte(index))
+		}
+		data, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		bucket, err := tx.Bucket(boltBindings).CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(index), data)
+	})
+}
+
+func (bs *boltStore) LoadBinding(name, index string) (map[string]string, error) {
+	var b map[string]string
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBindings).Bucket([]byte(name))
+		if bucket == nil {
+			return nil
+		}
+		v := bucket.Get([]byte(index))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &b)
+	})
+	return b, err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltStore(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "noids.bolt")
+	store, err := NewBoltStore(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := store.(*boltStore)
+	defer bs.Close()
+
+	pi := PoolInfo{
+		Name:     "test",
+		Template: ".zd+0",
+		Created:  time.Now(),
+		Tags:     map[string]string{"a": "b"},
+	}
+	err = bs.SavePool("test", pi)
+	if err == nil {
+		pi.Template = ".zd+5"
+		err = bs.SavePool("test", pi)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	pis, err := bs.LoadAllPools()
+	if err != nil || len(pis) != 1 || pis[0].Template != ".zd+5" || pis[0].Tags["a"] != "b" {
+		t.Errorf("Got %v, %v", pis, err)
+	}
+
+	err = bs.SaveBinding("test", "3", map[string]string{"target": "http://example.org/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := bs.LoadBinding("test", "3")
+	if err != nil || b["target"] != "http://example.org/" {
+		t.Errorf("Got %v, %v", b, err)
+	}
+	b, err = bs.LoadBinding("other", "3")
+	if err != nil || b != nil {
+		t.Errorf("Got %v, %v", b, err)
+	}
+
+	// only one server may use the file
+	_, err = NewBoltStore(fname)
+	if !errors.Is(err, StoreLocked) || !strings.Contains(err.Error(), lockHolder()) {
+		t.Errorf("Expected StoreLocked, got %v", err)
+	}
+
+	err = bs.DeletePool("test", Tombstone{Name: "test", Template: ".zd+5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pis, err = bs.LoadAllPools()
+	if err != nil || len(pis) != 0 {
+		t.Errorf("Got %v, %v", pis, err)
+	}
+	tombs, err := bs.LoadAllTombstones()
+	if err != nil || len(tombs) != 1 || tombs[0].Name != "test" {
+		t.Errorf("Got %v, %v", tombs, err)
+	}
+	b, err = bs.LoadBinding("test", "3")
+	if err != nil || b != nil {
+		t.Errorf("Got %v, %v", b, err)
+	}
+
+	// pools which cannot be loaded are quarantined
+	bs.SavePool("bad", PoolInfo{Name: "bad", Template: ".bad"})
+	pg := NewPoolGroup()
+	err = pg.LoadPoolsFromStore(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped := pg.Skipped(); len(skipped) != 1 || skipped[0].Quarantine == "" {
+		t.Errorf("Got %v", skipped)
+	}
+	pis, err = bs.LoadAllPools()
+	if err != nil || len(pis) != 0 {
+		t.Errorf("Got %v, %v", pis, err)
+	}
+}
+
+func TestBoltMintRecords(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "noids.bolt")
+	store, err := NewBoltStore(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := store.(*boltStore)
+	defer bs.Close()
+
+	now := time.Now()
+	pi := PoolInfo{Name: "test", Template: ".sd+2", MintRecords: []MintRecord{
+		{Key: "old", Count: 1, Ids: []string{"0"}, Time: now.Add(-2 * IdempotencyWindow)},
+		{Key: "new", Count: 1, Ids: []string{"1"}, Time: now},
+	}}
+	err = bs.SavePool("test", pi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi.MintRecords = append(pi.MintRecords, MintRecord{Key: "newer", Count: 1, Ids: []string{"2"}, Time: now.Add(time.Second)})
+	err = bs.SavePool("test", pi)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the records are not kept with the pool, and expired ones are removed
+	var n int
+	bs.db.View(func(tx *bolt.Tx) error {
+		if strings.Contains(string(tx.Bucket(boltPools).Get([]byte("test"))), "MintRecords") {
+			t.Errorf("Expected the records to be kept apart")
+		}
+		n = tx.Bucket(boltMintRecords).Bucket([]byte("test")).Stats().KeyN
+		return nil
+	})
+	if n != 2 {
+		t.Errorf("Expected 2 records, got %d", n)
+	}
+	pis, err := bs.LoadAllPools()
+	if err != nil || len(pis) != 1 {
+		t.Fatalf("Got %v, %v", pis, err)
+	}
+	recs := pis[0].MintRecords
+	if len(recs) != 2 || recs[0].Key != "new" || recs[1].Key != "newer" {
+		t.Errorf("Got %v", recs)
+	}
+}
@@ -1,39 +1,121 @@
 package main
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"log"
+	"math/big"
+	"strings"
 	"time"
+
+	"github.com/ndlib/noids/noid"
 )
 
 type dbStore struct {
-	DB *sql.DB
+	DB    *sql.DB
+	mints *mintTable
 }
 
-const dbSchema = `CREATE TABLE IF NOT EXISTS noids (
+const dbBindingSchema = `CREATE TABLE IF NOT EXISTS noids_bindings (
+pool VARCHAR(255),
+idx VARCHAR(255),
+bindings TEXT,
+PRIMARY KEY (pool, idx)
+);`
+
+const dbTombstoneSchema = `CREATE TABLE IF NOT EXISTS noids_tombstones (
 name VARCHAR(255) PRIMARY KEY,
 template VARCHAR(255),
-closed BOOLEAN,
-lastmint VARCHAR(64)
+naan VARCHAR(64),
+deleted VARCHAR(64)
 );`
 
 // Create a PoolStore which will serialize noid pools as
 // records in a SQL database
 func NewDbFileStore(db *sql.DB) PoolStore {
-	// create table if necessary
-	_, err := db.Exec(dbSchema)
+	// create or upgrade the tables if necessary
+	_, err := upgradeSchema(db, dbMigrations)
 	if err != nil {
 		log.Printf("NewDbFileStore: %s", err.Error())
 		return nil
 	}
-	return &dbStore{DB: db}
+	return &dbStore{DB: db, mints: newMintTable(func(query string) string { return query })}
+}
+
+// dbColumns are the columns of the noids table holding a PoolInfo, in
+// the order used by dbValues() and scanPool().
+var dbColumns = []string{
+	"template", "closed", "lastmint", "naan", "shoulder", "mintkey",
+	"created", "description", "owner", "tags", "exclusions", "skipped",
+	"reservations", "recycled", "mintrecords", "blocksize", "advancedto",
+}
+
+// dbValues returns the values of pi for the columns in dbColumns.
+func dbValues(pi PoolInfo) ([]interface{}, error) {
+	lastmintText, err := pi.LastMint.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	createdText, err := pi.Created.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	var advancedTo string
+	if pi.AdvancedTo != nil {
+		advancedTo = pi.AdvancedTo.String()
+	}
+	// the optional fields are stored as JSON, or as "" if they are empty
+	var tags, exclusions, reservations, recycled []byte
+	for _, field := range []struct {
+		empty bool
+		value interface{}
+		text  *[]byte
+	}{
+		{len(pi.Tags) == 0, pi.Tags, &tags},
+		{pi.Exclusions.IsEmpty(), pi.Exclusions, &exclusions},
+		{len(pi.Reservations) == 0, pi.Reservations, &reservations},
+		{len(pi.Recycled) == 0, pi.Recycled, &recycled},
+	} {
+		if field.empty {
+			continue
+		}
+		*field.text, err = json.Marshal(field.value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []interface{}{
+		pi.Template, pi.Closed, string(lastmintText), pi.NAAN, pi.Shoulder, hex.EncodeToString(pi.Key),
+		string(createdText), pi.Description, pi.Owner, string(tags), string(exclusions), pi.Skipped,
+		// the mint records are kept in the noids_mintrecords table
+		string(reservations), string(recycled), "", pi.BlockSize, advancedTo,
+	}, nil
+}
+
+// dbSetClause returns "col1 = ?, col2 = ?, ..." for dbColumns.
+func dbSetClause() string {
+	var set []string
+	for _, c := range dbColumns {
+		set = append(set, c+" = ?")
+	}
+	return strings.Join(set, ", ")
 }
 
 func (d *dbStore) SavePool(name string, pi PoolInfo) error {
 	log.Println("Save (db)", name)
-	lastmintText, err := pi.LastMint.MarshalText()
-	result, err := d.DB.Exec("UPDATE noids SET template = ?, closed = ?, lastmint = ? WHERE name = ?", pi.Template, pi.Closed, string(lastmintText), name)
+	values, err := dbValues(pi)
+	if err != nil {
+		return err
+	}
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec("UPDATE noids SET "+dbSetClause()+", version = COALESCE(version, 0) + 1 WHERE name = ?", append(values, name)...)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 	nrows, err := result.RowsAffected()
@@ -41,53 +123,480 @@ func (d *dbStore) SavePool(name string, pi PoolInfo) error {
 		// driver does not support row count
 		// see if the record is in the database in the first place
 		// TODO(dbrower)
+		tx.Rollback()
 		return err
 	}
 	switch {
 	case nrows == 0:
 		log.Println("Creating new db record for", name)
-		_, err = d.DB.Exec("INSERT INTO noids VALUES (?, ?, ?, ?)", name, pi.Template, pi.Closed, string(lastmintText))
+		err = insertPool(tx, name, values)
 	case nrows == 1:
 	default:
 		log.Printf("There is more than one row in the database for pool '%s'", name)
 		// TODO(dbrower): make error constant for this
 		err = nil
 	}
+	if err == nil {
+		err = d.mints.save(tx, name, pi.MintRecords)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err == nil {
+		d.mints.mark(name, pi.MintRecords)
+	}
 	return err
 }
 
+// an execer is either a *sql.DB or a *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertPool adds a row for the pool `name` having the given values.
+func insertPool(db execer, name string, values []interface{}) error {
+	marks := strings.Repeat(", ?", len(dbColumns))
+	_, err := db.Exec("INSERT INTO noids (name, "+strings.Join(dbColumns, ", ")+", version) VALUES (?"+marks+", 1)",
+		append([]interface{}{name}, values...)...)
+	return err
+}
+
+// rowScanner is either a *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// dbSelect selects the columns read by scanPool
+var dbSelect = "SELECT name, " + strings.Join(dbColumns, ", ") + ", COALESCE(version, 0) FROM noids"
+
+// scanPool reads a row selected with dbSelect. Returns the pool and
+// its version.
+func scanPool(row rowScanner) (PoolInfo, int64, error) {
+	var (
+		name, template, lastmint sql.NullString
+		naan, shoulder, mintkey  sql.NullString
+		created, description     sql.NullString
+		owner, tags, exclusions  sql.NullString
+		reservations, recycled   sql.NullString
+		mintrecords, advancedto  sql.NullString
+		skipped, blocksize       sql.NullInt64
+		closed                   sql.NullBool
+		lm, cr                   time.Time
+		version                  int64
+		pi                       PoolInfo
+	)
+	err := row.Scan(&name, &template, &closed, &lastmint, &naan, &shoulder, &mintkey, &created, &description, &owner, &tags, &exclusions, &skipped, &reservations, &recycled, &mintrecords, &blocksize, &advancedto, &version)
+	// so a pool which cannot be read can be named
+	pi.Name = name.String
+	if err != nil {
+		return pi, 0, err
+	}
+	key, err := hex.DecodeString(mintkey.String)
+	if err != nil {
+		return pi, 0, err
+	}
+	err = (&lm).UnmarshalText([]byte(lastmint.String))
+	if err != nil {
+		return pi, 0, err
+	}
+	// pools saved before the created column was added have no date
+	if created.String != "" {
+		err = (&cr).UnmarshalText([]byte(created.String))
+		if err != nil {
+			return pi, 0, err
+		}
+	}
+	pi = PoolInfo{
+		Name:     name.String,
+		Template: template.String,
+		Closed:   closed.Bool,
+		LastMint: lm,
+		NAAN:     naan.String,
+		Shoulder: shoulder.String,
+		Created:  cr,
+
+		Description: description.String,
+		Owner:       owner.String,
+		Skipped:     skipped.Int64,
+		BlockSize:   blocksize.Int64,
+	}
+	if len(key) > 0 {
+		pi.Key = key
+	}
+	if advancedto.String != "" {
+		var ok bool
+		pi.AdvancedTo, ok = new(big.Int).SetString(advancedto.String, 10)
+		if !ok {
+			return pi, 0, noid.PositionError
+		}
+	}
+	for _, field := range []struct {
+		text  sql.NullString
+		value interface{}
+	}{
+		{tags, &pi.Tags},
+		{exclusions, &pi.Exclusions},
+		{reservations, &pi.Reservations},
+		{recycled, &pi.Recycled},
+		// pools saved before the noids_mintrecords table was added
+		{mintrecords, &pi.MintRecords},
+	} {
+		if field.text.String == "" {
+			continue
+		}
+		err = json.Unmarshal([]byte(field.text.String), field.value)
+		if err != nil {
+			return pi, 0, err
+		}
+	}
+	return pi, version, nil
+}
+
+// Lock keeps other servers from using the database while this one does.
+func (d *dbStore) Lock() (func(), error) {
+	return takeLeaseLock(d.DB, func(query string) string { return query })
+}
+
 func (d *dbStore) LoadAllPools() ([]PoolInfo, error) {
-	var pis []PoolInfo
+	return dbLoadAllPools(d.DB, d.mints)
+}
 
-	rows, err := d.DB.Query("SELECT name, template, closed, lastmint FROM noids")
+// dbLoadAllPools reads every pool from the noids table in db, and their
+// mint records from mints.
+func dbLoadAllPools(db *sql.DB, mints *mintTable) ([]PoolInfo, error) {
+	var (
+		pis     []PoolInfo
+		skipped SkippedRecords
+	)
+
+	records, err := mints.load(db, "")
+	if err != nil {
+		return pis, err
+	}
+	rows, err := db.Query(dbSelect)
 	if err != nil {
 		return pis, err
 	}
 	defer rows.Close()
+	for rows.Next() {
+		pi, _, err := scanPool(rows)
+		if err != nil {
+			skipped = append(skipped, SkippedRecord{Name: pi.Name, Error: err.Error()})
+			continue
+		}
+		pi.MintRecords = append(pi.MintRecords, records[pi.Name]...)
+		pis = append(pis, pi)
+	}
+	if err := rows.Err(); err != nil {
+		return pis, err
+	}
+	if len(skipped) > 0 {
+		return pis, skipped
+	}
+	return pis, nil
+}
+
+func (d *dbStore) DeletePool(name string, tomb Tombstone) error {
+	log.Println("Delete (db)", name)
+	deletedText, err := tomb.Deleted.MarshalText()
+	if err != nil {
+		return err
+	}
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO noids_tombstones (name, template, naan, deleted) VALUES (?, ?, ?, ?)", name, tomb.Template, tomb.NAAN, string(deletedText))
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM noids_bindings WHERE pool = ?", name)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM noids_mintrecords WHERE pool = ?", name)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM noids WHERE name = ?", name)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *dbStore) LoadAllTombstones() ([]Tombstone, error) {
+	return dbLoadAllTombstones(d.DB)
+}
+
+// dbLoadAllTombstones reads every tombstone from the noids_tombstones
+// table in db.
+func dbLoadAllTombstones(db *sql.DB) ([]Tombstone, error) {
+	var (
+		tombs   []Tombstone
+		skipped SkippedRecords
+	)
+
+	rows, err := db.Query("SELECT name, template, naan, deleted FROM noids_tombstones")
+	if err != nil {
+		return tombs, err
+	}
+	defer rows.Close()
 	for rows.Next() {
 		var (
-			name, template, lastmint sql.NullString
-			closed                   sql.NullBool
-			lm                       time.Time
+			name, template, naan, deleted sql.NullString
+			tomb                          Tombstone
 		)
-		err := rows.Scan(&name, &template, &closed, &lastmint)
+		err := rows.Scan(&name, &template, &naan, &deleted)
 		if err != nil {
-			return pis, err
+			return tombs, err
 		}
-		err = (&lm).UnmarshalText([]byte(lastmint.String))
+		err = tomb.Deleted.UnmarshalText([]byte(deleted.String))
 		if err != nil {
-			return pis, err
-		}
-		pi := PoolInfo{
-			Name:     name.String,
-			Template: template.String,
-			Closed:   closed.Bool,
-			LastMint: lm,
+			skipped = append(skipped, SkippedRecord{Name: name.String, Error: err.Error(), Tombstone: true})
+			continue
 		}
-		pis = append(pis, pi)
+		tomb.Name = name.String
+		tomb.Template = template.String
+		tomb.NAAN = naan.String
+		tombs = append(tombs, tomb)
 	}
 	if err := rows.Err(); err != nil {
-		return pis, err
+		return tombs, err
 	}
-	return pis, nil
+	if len(skipped) > 0 {
+		return tombs, skipped
+	}
+	return tombs, nil
+}
+
+func (d *dbStore) SaveBinding(name, index string, b map[string]string) error {
+	log.Println("Save binding (db)", name, index)
+	if len(b) == 0 {
+		_, err := d.DB.Exec("DELETE FROM noids_bindings WHERE pool = ? AND idx = ?", name, index)
+		return err
+	}
+	text, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	result, err := d.DB.Exec("UPDATE noids_bindings SET bindings = ? WHERE pool = ? AND idx = ?", string(text), name, index)
+	if err != nil {
+		return err
+	}
+	nrows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if nrows == 0 {
+		_, err = d.DB.Exec("INSERT INTO noids_bindings (pool, idx, bindings) VALUES (?, ?, ?)", name, index, string(text))
+	}
+	return err
+}
+
+func (d *dbStore) LoadBinding(name, index string) (map[string]string, error) {
+	var text string
+	err := d.DB.QueryRow("SELECT bindings FROM noids_bindings WHERE pool = ? AND idx = ?", name, index).Scan(&text)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var b map[string]string
+	err = json.Unmarshal([]byte(text), &b)
+	return b, err
+}
+
+const dbMintRecordSchema = `CREATE TABLE IF NOT EXISTS noids_mintrecords (
+pool VARCHAR(255),
+keyhash VARCHAR(64),
+mintkey TEXT,
+idcount BIGINT,
+ids MEDIUMTEXT,
+minted VARCHAR(64),
+expires BIGINT,
+PRIMARY KEY (pool, keyhash)
+);`
+
+// mintTable keeps the mint records of the pools in a database in the
+// noids_mintrecords table, one row per record, keyed by a hash of the
+// idempotency key. A save only writes the records made since the pool was
+// last saved, and removes the ones older than IdempotencyWindow.
+type mintTable struct {
+	rebind func(string) string
+	mintMarks
+}
+
+func newMintTable(rebind func(string) string) *mintTable {
+	return &mintTable{rebind: rebind}
+}
+
+// save writes the records in recs which are not in the table yet.
+func (m *mintTable) save(tx *sql.Tx, name string, recs []MintRecord) error {
+	for _, rec := range m.unsaved(name, recs) {
+		ids, err := json.Marshal(rec.Ids)
+		if err != nil {
+			return err
+		}
+		minted, err := rec.Time.MarshalText()
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256([]byte(rec.Key))
+		values := []interface{}{rec.Key, rec.Count, string(ids), string(minted),
+			rec.Time.Add(IdempotencyWindow).UnixNano(), name, hex.EncodeToString(hash[:])}
+		result, err := tx.Exec(m.rebind("UPDATE noids_mintrecords SET mintkey = ?, idcount = ?, ids = ?, minted = ?, expires = ? WHERE pool = ? AND keyhash = ?"), values...)
+		if err != nil {
+			return err
+		}
+		nrows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if nrows == 0 {
+			_, err = tx.Exec(m.rebind("INSERT INTO noids_mintrecords (mintkey, idcount, ids, minted, expires, pool, keyhash) VALUES (?, ?, ?, ?, ?, ?, ?)"), values...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err := tx.Exec(m.rebind("DELETE FROM noids_mintrecords WHERE pool = ? AND expires < ?"), name, time.Now().UnixNano())
+	return err
+}
+
+// load reads the unexpired records of the pool `name`, or of every pool
+// if name is "", and returns them by pool.
+func (m *mintTable) load(db *sql.DB, name string) (map[string][]MintRecord, error) {
+	query := "SELECT pool, mintkey, idcount, ids, minted FROM noids_mintrecords WHERE expires >= ?"
+	args := []interface{}{time.Now().UnixNano()}
+	if name != "" {
+		query += " AND pool = ?"
+		args = append(args, name)
+	}
+	rows, err := db.Query(m.rebind(query+" ORDER BY expires"), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := make(map[string][]MintRecord)
+	for rows.Next() {
+		var (
+			pool, ids, minted string
+			rec               MintRecord
+		)
+		err = rows.Scan(&pool, &rec.Key, &rec.Count, &ids, &minted)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(ids), &rec.Ids)
+		if err != nil {
+			return nil, err
+		}
+		err = rec.Time.UnmarshalText([]byte(minted))
+		if err != nil {
+			return nil, err
+		}
+		records[pool] = append(records[pool], rec)
+	}
+	for pool, recs := range records {
+		m.mark(pool, recs)
+	}
+	return records, rows.Err()
+}
+
+// sharedDbStore is a dbStore which several servers may share. Each save
+// checks the version column of the pool's row, so two servers can never
+// save conflicting changes to a pool.
+type sharedDbStore struct {
+	*dbStore
+}
+
+// Create a SharedStore which will serialize noid pools as records in a
+// SQL database, which may be shared with other servers.
+func NewSharedDbStore(db *sql.DB) PoolStore {
+	ps := NewDbFileStore(db)
+	if ps == nil {
+		return nil
+	}
+	return &sharedDbStore{dbStore: ps.(*dbStore)}
+}
+
+func (d *sharedDbStore) LoadPool(name string) (PoolInfo, int64, error) {
+	pi, version, err := scanPool(d.DB.QueryRow(dbSelect+" WHERE name = ?", name))
+	if err == sql.ErrNoRows {
+		err = NoSuchPool
+	}
+	if err != nil {
+		return pi, version, err
+	}
+	records, err := d.mints.load(d.DB, name)
+	pi.MintRecords = append(pi.MintRecords, records[name]...)
+	return pi, version, err
+}
+
+func (d *sharedDbStore) SavePoolVersion(name string, pi PoolInfo, version int64) (int64, error) {
+	log.Println("Save (shared db)", name, version)
+	values, err := dbValues(pi)
+	if err != nil {
+		return 0, err
+	}
+	values = append(values, version+1, name, version)
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec("UPDATE noids SET "+dbSetClause()+", version = ? WHERE name = ? AND COALESCE(version, 0) = ?", values...)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	nrows, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if nrows == 0 {
+		tx.Rollback()
+		// either the pool was deleted, or someone else saved it
+		_, _, err = d.LoadPool(name)
+		if err == nil {
+			err = VersionConflict
+		}
+		return 0, err
+	}
+	err = d.mints.save(tx, name, pi.MintRecords)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	d.mints.mark(name, pi.MintRecords)
+	return version + 1, nil
+}
+
+func (d *sharedDbStore) InsertPool(name string, pi PoolInfo) error {
+	log.Println("Insert (shared db)", name)
+	var n int
+	err := d.DB.QueryRow("SELECT COUNT(*) FROM noids_tombstones WHERE name = ?", name).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return NameUsed
+	}
+	values, err := dbValues(pi)
+	if err != nil {
+		return err
+	}
+	err = insertPool(d.DB, name, values)
+	if err != nil {
+		// the most likely reason is that the name is taken
+		if _, _, err2 := d.LoadPool(name); err2 == nil {
+			return NameExists
+		}
+	}
+	return err
 }
@@ -2,6 +2,11 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -22,6 +27,11 @@ func TestDbSavePool(t *testing.T) {
 		Template: ".zd+0",
 		Closed:   false,
 		LastMint: time.Now(),
+		NAAN:     "13030",
+		Shoulder: "xf",
+		Created:  time.Now(),
+		Owner:    "library",
+		Tags:     map[string]string{"a": "b"},
 	})
 
 	pis, err := ps.LoadAllPools()
@@ -29,7 +39,8 @@ func TestDbSavePool(t *testing.T) {
 		t.Logf(err.Error())
 		return
 	}
-	if len(pis) == 1 && pis[0].Name == "test" {
+	if len(pis) == 1 && pis[0].Name == "test" && pis[0].NAAN == "13030" && pis[0].Shoulder == "xf" &&
+		pis[0].Owner == "library" && pis[0].Tags["a"] == "b" && !pis[0].Created.IsZero() {
 		// good
 	} else {
 		t.Logf("pool was not saved")
@@ -37,3 +48,302 @@ func TestDbSavePool(t *testing.T) {
 		return
 	}
 }
+
+func TestDbDeletePool(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Skip(err)
+		return
+	}
+	defer db.Close()
+	// each connection would have its own in-memory database
+	db.SetMaxOpenConns(1)
+
+	ps := NewDbFileStore(db)
+	ps.SavePool("test", PoolInfo{Name: "test", Template: ".zd+0", Closed: true})
+	deleted := time.Now().Round(time.Second)
+	err = ps.DeletePool("test", Tombstone{Name: "test", Template: ".zd+0", Deleted: deleted})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pis, err := ps.LoadAllPools()
+	if err != nil || len(pis) != 0 {
+		t.Errorf("Got %v, %v", pis, err)
+	}
+	tombs, err := ps.LoadAllTombstones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tombs) != 1 || tombs[0].Name != "test" || !tombs[0].Deleted.Equal(deleted) {
+		t.Errorf("Got %v", tombs)
+	}
+}
+
+func TestSharedDbStore(t *testing.T) {
+	// two servers sharing one database
+	fname := filepath.Join(t.TempDir(), "noids.db") + "?_busy_timeout=5000"
+	var stores []PoolStore
+	for i := 0; i < 2; i++ {
+		db, err := sql.Open("sqlite3", fname)
+		if err != nil {
+			t.Skip(err)
+			return
+		}
+		defer db.Close()
+		stores = append(stores, NewSharedDbStore(db))
+	}
+	defer func() { DefaultStore = NullStore{} }()
+
+	DefaultStore = stores[0]
+	pg1 := NewPoolGroup()
+	_, err := pg1.AddPool("test", ".sddd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	DefaultStore = stores[1]
+	pg2 := NewPoolGroup()
+	err = pg2.LoadPoolsFromStore(stores[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pg2.AddPool("test", ".sddd")
+	if err != NameExists {
+		t.Errorf("Expected NameExists, got %v", err)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		seen = make(map[string]bool)
+	)
+	for _, pg := range []*poolGroup{pg1, pg2, pg1, pg2} {
+		wg.Add(1)
+		go func(pg *poolGroup) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				ids, err := pg.PoolMint("test", 5)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				for _, id := range ids {
+					if seen[id] {
+						t.Errorf("%s was minted twice", id)
+					}
+					seen[id] = true
+				}
+				mu.Unlock()
+			}
+		}(pg)
+	}
+	wg.Wait()
+	if len(seen) != 200 {
+		t.Errorf("Expected 200 ids, got %d", len(seen))
+	}
+	for _, pg := range []*poolGroup{pg1, pg2} {
+		pi, err := pg.GetPool("test")
+		if err != nil || pi.Used.Int64() != 200 {
+			t.Errorf("Got %v, %v", pi, err)
+		}
+	}
+
+	// changes made by one server are seen by the other
+	_, err = pg1.SetPoolState("test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pg2.PoolMint("test", 1)
+	if err != PoolClosed {
+		t.Errorf("Expected PoolClosed, got %v", err)
+	}
+	DefaultStore = stores[0]
+	_, err = pg1.AddPool("other", ".sd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	DefaultStore = stores[1]
+	_, err = pg2.GetPool("other")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = pg2.DeletePool("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pg1.GetPool("test")
+	if err != NoSuchPool {
+		t.Errorf("Expected NoSuchPool, got %v", err)
+	}
+}
+
+func TestSharedAdvancePast(t *testing.T) {
+	// two servers leasing blocks from one database
+	fname := filepath.Join(t.TempDir(), "noids.db") + "?_busy_timeout=5000"
+	var stores []PoolStore
+	for i := 0; i < 2; i++ {
+		db, err := sql.Open("sqlite3", fname)
+		if err != nil {
+			t.Skip(err)
+			return
+		}
+		defer db.Close()
+		stores = append(stores, NewSharedDbStore(db))
+	}
+	defer func() { DefaultStore = NullStore{} }()
+
+	DefaultStore = stores[0]
+	pg1 := NewPoolGroup()
+	_, err := pg1.CreatePool(PoolInfo{Name: "test", Template: ".sddd", BlockSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	DefaultStore = stores[1]
+	pg2 := NewPoolGroup()
+	err = pg2.LoadPoolsFromStore(stores[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pg1 leases 0-9 and pg2 leases 10-19
+	ids, err := pg1.PoolMint("test", 1)
+	if err != nil || ids[0] != "000" {
+		t.Fatalf("Got %v, %v", ids, err)
+	}
+	ids, err = pg2.PoolMint("test", 1)
+	if err != nil || ids[0] != "010" {
+		t.Fatalf("Got %v, %v", ids, err)
+	}
+
+	// advancing past an id in the block pg1 leased stops pg1 minting it
+	_, err = pg2.PoolAdvancePast("test", "005")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err = pg1.PoolMint("test", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"006", "007", "008", "009", "020"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Expected %v, got %v", expected, ids)
+	}
+}
+
+func TestDbSkipCorruptPool(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ps := NewDbFileStore(db)
+	ps.SavePool("good", PoolInfo{Name: "good", Template: ".sd+1"})
+	ps.SavePool("bad", PoolInfo{Name: "bad", Template: ".sd+1"})
+	_, err = db.Exec("UPDATE noids SET tags = '{' WHERE name = 'bad'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pis, err := ps.LoadAllPools()
+	skipped, ok := err.(SkippedRecords)
+	if !ok || len(skipped) != 1 || skipped[0].Name != "bad" {
+		t.Errorf("Got %v", err)
+	}
+	if len(pis) != 1 || pis[0].Name != "good" {
+		t.Errorf("Got %v", pis)
+	}
+}
+
+func TestDbMintRecords(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ps := NewDbFileStore(db)
+	now := time.Now()
+	pi := PoolInfo{Name: "test", Template: ".sd+2", MintRecords: []MintRecord{
+		{Key: "old", Count: 1, Ids: []string{"0"}, Time: now.Add(-2 * IdempotencyWindow)},
+		{Key: "new", Count: 1, Ids: []string{"1"}, Time: now},
+	}}
+	err = ps.SavePool("test", pi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// saving again only adds the new record
+	pi.MintRecords = append(pi.MintRecords, MintRecord{Key: "newer", Count: 1, Ids: []string{"2"}, Time: now.Add(time.Second)})
+	pi.Template = ".sd+3"
+	err = ps.SavePool("test", pi)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the records are not kept in the pool's row
+	var text sql.NullString
+	err = db.QueryRow("SELECT mintrecords FROM noids WHERE name = 'test'").Scan(&text)
+	if err != nil || text.String != "" {
+		t.Errorf("Got %q, %v", text.String, err)
+	}
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM noids_mintrecords").Scan(&n)
+	if n != 2 {
+		t.Errorf("Expected 2 rows, got %d", n)
+	}
+
+	pis, err := NewDbFileStore(db).LoadAllPools()
+	if err != nil || len(pis) != 1 {
+		t.Fatalf("Got %v, %v", pis, err)
+	}
+	recs := pis[0].MintRecords
+	if len(recs) != 2 || recs[0].Key != "new" || recs[1].Key != "newer" || recs[1].Ids[0] != "2" || !recs[0].Time.Equal(now) {
+		t.Errorf("Got %v", recs)
+	}
+}
+
+func TestDbLargeReservation(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// more than the 64KB a MySQL TEXT column holds
+	r := Reservation{Token: "abc", Expires: time.Now().Add(time.Hour)}
+	for i := 0; i < 1000; i++ {
+		r.Ids = append(r.Ids, fmt.Sprintf("%s%04d", strings.Repeat("x", 80), i))
+	}
+	ps := NewDbFileStore(db)
+	err = ps.SavePool("test", PoolInfo{Name: "test", Template: ".sd+0", Reservations: []Reservation{r}, Recycled: r.Ids})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pis, err := ps.LoadAllPools()
+	if err != nil || len(pis) != 1 {
+		t.Fatalf("Got %v, %v", pis, err)
+	}
+	if len(pis[0].Reservations) != 1 || len(pis[0].Reservations[0].Ids) != 1000 || len(pis[0].Recycled) != 1000 {
+		t.Errorf("Got %v", pis[0])
+	}
+
+	rows, err := db.Query("PRAGMA table_info(noids)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid, notnull, pk int
+			name, ctype      string
+			dflt             sql.NullString
+		)
+		rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk)
+		if (name == "reservations" || name == "recycled") && ctype != "MEDIUMTEXT" {
+			t.Errorf("Column %s is %s", name, ctype)
+		}
+	}
+}
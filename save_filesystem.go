@@ -1,78 +1,641 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net/url"
 	"os"
 	"path"
 	"regexp"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type dirstore struct {
 	root string
+	// a read only store never changes the directory, e.g. by moving a
+	// file which cannot be loaded into quarantine
+	readOnly bool
+	mints    mintMarks
 }
 
+// Pool files are named with the pool's name, percent-encoded, followed by
+// this extension. Only letters, digits, "-" and "_" are left as they are,
+// so every pool has its own file, and no file name begins with ".".
+const poolExt = ".json"
+
+// tombstones are kept in this subdirectory. Since pool file names never
+// begin with ".", it cannot clash with a pool.
+const tombstoneDir = "..tombstones"
+
+// the bindings for a pool are kept in a subdirectory of this one, with
+// a file for each bound id.
+const bindingDir = "..bindings"
+
+// the mint records of a pool are kept in a subdirectory of this one, with
+// a file for each record named by mintRecordName().
+const mintRecordDir = "..mintrecords"
+
+// Files are first written with this suffix, and then renamed into place.
+// The previous version of a pool is kept with the backup suffix. Neither
+// can clash with a pool, since poolExt is not followed by "..".
+const (
+	tempSuffix   = "..tmp"
+	backupSuffix = "..bak"
+)
+
+// Each file holds a line of JSON followed by a line with its checksum, so
+// a file which was not completely written can be detected. Files written
+// by older versions have no checksum.
+const checksumPrefix = "sha256 "
+
+var (
+	CorruptFile   = errors.New("File is corrupt")
+	ReadOnlyStore = errors.New("Store is read only")
+)
+
+// pool files which cannot be loaded are moved into this subdirectory
+const quarantineDir = "..quarantine"
+
+// The server holding the directory keeps this file locked, and writes
+// who it is into it.
+const lockFile = "..lock"
+
 // Create a PoolStore which will serialize noid pools as
 // json files in a directory.
 func NewJsonFileStore(dirname string) PoolStore {
 	return &dirstore{root: dirname}
 }
 
+// Create a PoolStore which reads the json files in a directory without
+// changing them. Saving to it is not supported.
+func NewReadOnlyFileStore(dirname string) PoolStore {
+	return &dirstore{root: dirname, readOnly: true}
+}
+
 func (d *dirstore) SavePool(name string, pi PoolInfo) error {
+	if d.readOnly {
+		return ReadOnlyStore
+	}
 	log.Println("Save (filesystem)", name)
-	f, err := os.Create(sanitizeName(d.root, name))
+	recs := pi.MintRecords
+	pi.MintRecords = nil
+	data, err := encodeChecked(pi)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	err = writeFileAtomic(d.poolFile(name), data, true)
+	if err != nil {
+		return err
+	}
+	// the records are written after the pool, so a record is never
+	// saved for ids the pool could mint again
+	return d.saveMintRecords(name, recs)
+}
+
+// saveMintRecords writes the records in recs which have not been saved,
+// and removes the expired ones.
+func (d *dirstore) saveMintRecords(name string, recs []MintRecord) error {
+	recs = d.mints.unsaved(name, recs)
+	if len(recs) == 0 {
+		return nil
+	}
+	dir := d.mintRecordPath(name)
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		data, err := encodeChecked(rec)
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(path.Join(dir, mintRecordName(rec)), data, false)
+		if err != nil {
+			return err
+		}
+	}
+	d.mints.mark(name, recs)
+	fis, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	cutoff := mintRecordCutoff()
+	for _, fi := range fis {
+		if fi.Name() >= cutoff {
+			break
+		}
+		err = os.Remove(path.Join(dir, fi.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadMintRecords reads the unexpired records of the pool `name`. Records
+// which cannot be read are left out.
+func (d *dirstore) loadMintRecords(name string) ([]MintRecord, error) {
+	dir := d.mintRecordPath(name)
+	fis, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var recs []MintRecord
+	cutoff := mintRecordCutoff()
+	for _, fi := range fis {
+		if fi.Name() < cutoff || strings.HasSuffix(fi.Name(), tempSuffix) {
+			continue
+		}
+		var rec MintRecord
+		data, err := os.ReadFile(path.Join(dir, fi.Name()))
+		if err == nil {
+			err = decodeChecked(data, &rec)
+		}
+		if err != nil {
+			log.Printf("Ignoring mint record %s: %s", path.Join(dir, fi.Name()), err.Error())
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	d.mints.mark(name, recs)
+	return recs, nil
+}
+
+// Lock keeps other servers from using the directory while this one does.
+// The lock is released by the system if the server exits. A read only
+// store is not locked, since the lock file would be written into it.
+func (d *dirstore) Lock() (func(), error) {
+	if d.readOnly {
+		return func() {}, nil
+	}
+	f, err := os.OpenFile(path.Join(d.root, lockFile), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		holder, _ := io.ReadAll(f)
+		f.Close()
+		return nil, fmt.Errorf("%w: %s", StoreLocked, holder)
+	}
+	if err == nil {
+		err = f.Truncate(0)
+	}
+	if err == nil {
+		_, err = f.WriteString(lockHolder())
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		f.Truncate(0)
+		f.Close()
+	}, nil
+}
 
-	enc := json.NewEncoder(f)
-	enc.Encode(pi) // TODO: err here?
+// encodeChecked returns v as JSON followed by its checksum.
+func encodeChecked(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return append(data, "\n"+checksumPrefix+hex.EncodeToString(sum[:])+"\n"...), nil
+}
 
+// decodeChecked reads the JSON in data into v, after checking the
+// checksum, if there is one. Returns CorruptFile if data is not valid.
+func decodeChecked(data []byte, v interface{}) error {
+	body := bytes.TrimRight(data, "\n")
+	if i := bytes.LastIndexByte(body, '\n'); i >= 0 && bytes.HasPrefix(body[i+1:], []byte(checksumPrefix)) {
+		sum := sha256.Sum256(body[:i])
+		if string(body[i+1+len(checksumPrefix):]) != hex.EncodeToString(sum[:]) {
+			return CorruptFile
+		}
+		body = body[:i]
+	}
+	if json.Unmarshal(body, v) != nil {
+		return CorruptFile
+	}
 	return nil
 }
 
+// writeFileAtomic replaces the file fname with data. The data is written
+// to a temporary file, which is synced to the disk and then renamed, so
+// fname is never left partly written. If backup is set, the old version
+// of fname is kept.
+func writeFileAtomic(fname string, data []byte, backup bool) error {
+	tmp := fname + tempSuffix
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil && backup {
+		err = os.Rename(fname, fname+backupSuffix)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, fname)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// make sure the rename is on the disk
+	dir, err := os.Open(path.Dir(fname))
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if err2 := dir.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
 func (d *dirstore) LoadAllPools() ([]PoolInfo, error) {
-	var pis []PoolInfo
-	f, err := os.Open(d.root)
+	var (
+		pis     []PoolInfo
+		skipped SkippedRecords
+	)
+	// read the whole directory first, since files may be quarantined
+	fis, err := os.ReadDir(d.root)
 	if err != nil {
 		return pis, err
 	}
-	for {
-		names, err := f.Readdirnames(10)
-		if err != nil {
-			break
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() || name == lockFile || strings.HasSuffix(name, tempSuffix) {
+			continue
+		}
+		if strings.HasSuffix(name, backupSuffix) {
+			// the pool file is missing if the server stopped
+			// between renaming it and renaming the new one
+			name = strings.TrimSuffix(name, backupSuffix)
+			_, err := os.Stat(path.Join(d.root, name))
+			if !os.IsNotExist(err) {
+				continue
+			}
+			// or it was quarantined along with the pool file
+			_, err = os.Stat(path.Join(d.root, fi.Name()))
+			if os.IsNotExist(err) {
+				continue
+			}
 		}
-		for _, s := range names {
-			pi, err := d.loadpool(s)
-			if err != nil {
-				return pis, err
+		pi, err := d.loadpool(name)
+		if err == nil && name != path.Base(d.poolFile(pi.Name)) {
+			if name == legacyName(pi.Name) {
+				if !d.readOnly {
+					err = d.upgradeFile(pi.Name)
+				}
+			} else {
+				err = fmt.Errorf("File holds the pool %q", pi.Name)
 			}
-			pis = append(pis, pi)
 		}
+		if err == nil {
+			var recs []MintRecord
+			recs, err = d.loadMintRecords(pi.Name)
+			// pools saved before the records were kept apart
+			pi.MintRecords = append(pi.MintRecords, recs...)
+		}
+		if err != nil {
+			if strayFile(name) {
+				log.Printf("Ignoring %s: %s", name, err.Error())
+				continue
+			}
+			rec := SkippedRecord{Name: decodeName(name), Error: err.Error()}
+			if !d.readOnly {
+				rec.Quarantine, err = d.quarantineFile("", name)
+				if err != nil {
+					log.Printf("Error quarantining %s: %s", name, err.Error())
+				}
+			}
+			skipped = append(skipped, rec)
+			continue
+		}
+		pis = append(pis, pi)
+	}
+	if len(skipped) > 0 {
+		return pis, skipped
 	}
 	return pis, nil
 }
 
+// strayFile is true for file names which are likely not pools, such as
+// editor backups and dotfiles.
+func strayFile(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") ||
+		(strings.HasPrefix(name, "#") && strings.HasSuffix(name, "#"))
+}
+
+// Quarantine moves the files of the pool `name` into the quarantine
+// directory.
+func (d *dirstore) Quarantine(name string) (string, error) {
+	if d.readOnly {
+		return "", ReadOnlyStore
+	}
+	return d.quarantineFile("", path.Base(d.poolFile(name)))
+}
+
+// quarantineFile moves filename in the subdirectory subdir, and its
+// backup, into the same subdirectory of the quarantine directory, and
+// returns its new path. The time is added to the name, so earlier files are
+// not overwritten.
+func (d *dirstore) quarantineFile(subdir, filename string) (string, error) {
+	dir := path.Join(d.root, quarantineDir, subdir)
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return "", err
+	}
+	dest := path.Join(dir, filename+"."+time.Now().UTC().Format("20060102T150405.000000000"))
+	for _, suffix := range []string{"", backupSuffix} {
+		err = os.Rename(path.Join(d.root, subdir, filename+suffix), dest+suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	log.Printf("Moved %s to %s", filename, dest)
+	return dest, nil
+}
+
+func (d *dirstore) DeletePool(name string, tomb Tombstone) error {
+	if d.readOnly {
+		return ReadOnlyStore
+	}
+	log.Println("Delete (filesystem)", name)
+	dir := path.Join(d.root, tombstoneDir)
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return err
+	}
+	data, err := encodeChecked(tomb)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(path.Join(dir, encodeName(name)+poolExt), data, false)
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(d.bindingPath(name))
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(d.mintRecordPath(name))
+	if err != nil {
+		return err
+	}
+	err = os.Remove(d.poolFile(name) + backupSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(d.poolFile(name))
+	if os.IsNotExist(err) {
+		// e.g. a tombstone copied by the migrate command
+		err = nil
+	}
+	return err
+}
+
+func (d *dirstore) LoadAllTombstones() ([]Tombstone, error) {
+	var tombs []Tombstone
+	dir := path.Join(d.root, tombstoneDir)
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return tombs, nil
+	} else if err != nil {
+		return tombs, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return tombs, err
+	}
+	var skipped SkippedRecords
+	for _, s := range names {
+		if strings.HasSuffix(s, tempSuffix) || strayFile(s) {
+			continue
+		}
+		var tomb Tombstone
+		data, err := os.ReadFile(path.Join(dir, s))
+		if err == nil {
+			err = decodeChecked(data, &tomb)
+		}
+		if err != nil {
+			rec := SkippedRecord{Name: decodeName(s), Error: err.Error(), Tombstone: true}
+			if !d.readOnly {
+				rec.Quarantine, err = d.quarantineFile(tombstoneDir, s)
+				if err != nil {
+					log.Printf("Error quarantining tombstone %s: %s", s, err.Error())
+				}
+			}
+			skipped = append(skipped, rec)
+			continue
+		}
+		tombs = append(tombs, tomb)
+	}
+	if len(skipped) > 0 {
+		return tombs, skipped
+	}
+	return tombs, nil
+}
+
+// loadpool reads the pool in filename. If the file is missing, because
+// the server stopped while saving the pool, the previous version is read
+// instead and put back in place. If the file is corrupt, the previous
+// version is restored by restoreBackup.
 func (d *dirstore) loadpool(filename string) (PoolInfo, error) {
 	var pi PoolInfo
-	f, err := os.Open(sanitizeName(d.root, filename))
+	fname := path.Join(d.root, filename)
+	data, err := os.ReadFile(fname)
+	if err == nil {
+		err = decodeChecked(data, &pi)
+		if err == CorruptFile {
+			return d.restoreBackup(filename)
+		}
+		return pi, err
+	}
+	if !os.IsNotExist(err) {
+		return pi, err
+	}
+	data, berr := os.ReadFile(fname + backupSuffix)
+	if berr == nil {
+		berr = decodeChecked(data, &pi)
+	}
+	if berr != nil {
+		return pi, err
+	}
+	log.Printf("Pool file %s is missing, using its backup", fname)
+	if d.readOnly {
+		return pi, nil
+	}
+	err = writeFileAtomic(fname, data, false)
+	return pi, err
+}
+
+// restoreBackup replaces the corrupt file filename with its previous
+// version, and quarantines the corrupt file. Ids minted by the last change
+// to the pool may have been handed out, so the restored pool is closed and
+// marked degraded. Returns CorruptFile if there is no usable backup.
+func (d *dirstore) restoreBackup(filename string) (PoolInfo, error) {
+	var pi PoolInfo
+	fname := path.Join(d.root, filename)
+	data, err := os.ReadFile(fname + backupSuffix)
+	if err == nil {
+		err = decodeChecked(data, &pi)
+	}
+	if err != nil {
+		log.Printf("Pool file %s is corrupt, and has no usable backup", fname)
+		return pi, CorruptFile
+	}
+	log.Printf("Pool file %s is corrupt, restored its backup. The pool is closed until advancePast is used to skip past the last id minted, and the pool is opened.", fname)
+	pi.Closed = true
+	pi.Degraded = true
+	if d.readOnly {
+		return pi, nil
+	}
+	data, err = encodeChecked(pi)
 	if err != nil {
 		return pi, err
 	}
-	defer f.Close()
+	_, err = d.quarantineFile("", filename)
+	if err != nil {
+		return pi, err
+	}
+	err = writeFileAtomic(fname, data, false)
+	return pi, err
+}
 
-	dec := json.NewDecoder(f)
-	err = dec.Decode(&pi)
+// poolFile returns the path of the file for the pool `name`.
+func (d *dirstore) poolFile(name string) string {
+	return path.Join(d.root, encodeName(name)+poolExt)
+}
 
-	return pi, err
+// bindingPath returns the directory holding the bindings of the pool `name`.
+func (d *dirstore) bindingPath(name string) string {
+	return path.Join(d.root, bindingDir, encodeName(name))
+}
+
+// mintRecordPath returns the directory holding the mint records of the
+// pool `name`.
+func (d *dirstore) mintRecordPath(name string) string {
+	return path.Join(d.root, mintRecordDir, encodeName(name))
+}
+
+// encodeName percent-encodes name, except for letters, digits, "-" and "_".
+func encodeName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// decodeName returns the name of the pool in the file filename, or
+// filename if it is not a pool file.
+func decodeName(filename string) string {
+	if !strings.HasSuffix(filename, poolExt) {
+		return filename
+	}
+	name, err := url.PathUnescape(strings.TrimSuffix(filename, poolExt))
+	if err != nil {
+		return filename
+	}
+	return name
 }
 
 var (
 	badchars = regexp.MustCompile(`\.\.|/`)
 )
 
-func sanitizeName(root, s string) string {
-	s = badchars.ReplaceAllLiteralString(s, "_")
-	return path.Join(root, s)
+// legacyName returns the file name older versions used for the pool
+// `name`. Different pools could have the same one, e.g. "a/b" and "a_b".
+func legacyName(name string) string {
+	return badchars.ReplaceAllLiteralString(name, "_")
+}
+
+// upgradeFile renames the files of the pool `name` from the names older
+// versions used. The pool file is renamed last, so it is done again if
+// the server stops before then.
+func (d *dirstore) upgradeFile(name string) error {
+	log.Println("Renaming the files of pool", name)
+	oldBindings := path.Join(d.root, bindingDir, legacyName(name))
+	if oldBindings != d.bindingPath(name) {
+		err := os.Rename(oldBindings, d.bindingPath(name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	fname := d.poolFile(name)
+	if _, err := os.Stat(fname); err == nil {
+		return fmt.Errorf("File holds the pool %q, which is already in %s", name, fname)
+	}
+	old := path.Join(d.root, legacyName(name))
+	err := os.Rename(old+backupSuffix, fname+backupSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(old, fname)
+}
+
+func (d *dirstore) SaveBinding(name, index string, b map[string]string) error {
+	if d.readOnly {
+		return ReadOnlyStore
+	}
+	log.Println("Save binding (filesystem)", name, index)
+	dir := d.bindingPath(name)
+	fname := path.Join(dir, index)
+	if len(b) == 0 {
+		err := os.Remove(fname)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return err
+	}
+	data, err := encodeChecked(b)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fname, data, false)
+}
+
+func (d *dirstore) LoadBinding(name, index string) (map[string]string, error) {
+	dir := d.bindingPath(name)
+	data, err := os.ReadFile(path.Join(dir, index))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var b map[string]string
+	err = decodeChecked(data, &b)
+	return b, err
 }
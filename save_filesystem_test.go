@@ -0,0 +1,239 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJsonFileStoreChecksum(t *testing.T) {
+	dir := t.TempDir()
+	store := NewJsonFileStore(dir)
+	err := store.SavePool("test", PoolInfo{Name: "test", Template: ".sd+1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SavePool("test", PoolInfo{Name: "test", Template: ".sd+2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pis, err := store.LoadAllPools()
+	if err != nil || len(pis) != 1 || pis[0].Template != ".sd+2" {
+		t.Fatalf("Got %v, %v", pis, err)
+	}
+
+	// a changed file is detected
+	fname := path.Join(dir, "test.json")
+	data, _ := os.ReadFile(fname)
+	var pi PoolInfo
+	data[5] ^= 1
+	if decodeChecked(data, &pi) != CorruptFile {
+		t.Errorf("Expected CorruptFile")
+	}
+
+	// a corrupt pool is restored from its backup, but closed, since ids
+	// minted by the last change may have been handed out
+	os.WriteFile(fname, data[:len(data)/2], 0666)
+	pis, err = store.LoadAllPools()
+	if err != nil || len(pis) != 1 || pis[0].Template != ".sd+1" || !pis[0].Closed || !pis[0].Degraded {
+		t.Fatalf("Got %v, %v", pis, err)
+	}
+	quarantined, _ := os.ReadDir(path.Join(dir, quarantineDir))
+	if len(quarantined) != 2 {
+		t.Errorf("Expected the corrupt file and its backup to be quarantined, got %v", quarantined)
+	}
+	pg := NewPoolGroup()
+	pg.LoadPools(pis)
+	if degraded := pg.DegradedPools(); len(degraded) != 1 {
+		t.Errorf("Expected the pool to be degraded, got %v", degraded)
+	}
+	_, err = pg.PoolMint("test", 1)
+	if err != PoolClosed {
+		t.Errorf("Expected PoolClosed, got %v", err)
+	}
+	pis, err = store.LoadAllPools()
+	if err != nil || len(pis) != 1 || !pis[0].Closed {
+		t.Errorf("Expected the restored pool to be saved closed, got %v, %v", pis, err)
+	}
+
+	// without a backup it is skipped and quarantined
+	os.WriteFile(fname, data[:len(data)/2], 0666)
+	pis, err = store.LoadAllPools()
+	skipped, ok := err.(SkippedRecords)
+	if !ok || len(skipped) != 1 || skipped[0].Name != "test" || len(pis) != 0 {
+		t.Fatalf("Got %v, %v", pis, err)
+	}
+	if _, err := os.Stat(skipped[0].Quarantine); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(fname); !os.IsNotExist(err) {
+		t.Errorf("%s was not moved: %v", fname, err)
+	}
+}
+
+func TestJsonFileStoreMintRecords(t *testing.T) {
+	dir := t.TempDir()
+	store := NewJsonFileStore(dir)
+	now := time.Now()
+	pi := PoolInfo{Name: "test", Template: ".sd+2", MintRecords: []MintRecord{
+		{Key: "old", Count: 1, Ids: []string{"0"}, Time: now.Add(-2 * IdempotencyWindow)},
+		{Key: "new", Count: 1, Ids: []string{"1"}, Time: now},
+	}}
+	err := store.SavePool("test", pi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi.MintRecords = append(pi.MintRecords, MintRecord{Key: "newer", Count: 1, Ids: []string{"2"}, Time: now.Add(time.Second)})
+	pi.Template = ".sd+3"
+	err = store.SavePool("test", pi)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the records are not kept in the pool file, and expired ones are removed
+	data, _ := os.ReadFile(path.Join(dir, "test.json"))
+	if strings.Contains(string(data), "MintRecords") {
+		t.Errorf("Got %s", data)
+	}
+	files, _ := os.ReadDir(path.Join(dir, mintRecordDir, "test"))
+	if len(files) != 2 {
+		t.Errorf("Expected 2 records, got %v", files)
+	}
+
+	pis, err := NewJsonFileStore(dir).LoadAllPools()
+	if err != nil || len(pis) != 1 {
+		t.Fatalf("Got %v, %v", pis, err)
+	}
+	recs := pis[0].MintRecords
+	if len(recs) != 2 || recs[0].Key != "new" || recs[1].Key != "newer" || !recs[0].Time.Equal(now) {
+		t.Errorf("Got %v", recs)
+	}
+
+	err = store.DeletePool("test", Tombstone{Name: "test", Template: ".sd+3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, mintRecordDir, "test")); !os.IsNotExist(err) {
+		t.Errorf("Expected the records to be removed, got %v", err)
+	}
+}
+
+func TestJsonFileStoreInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	store := NewJsonFileStore(dir)
+	err := store.SavePool("test", PoolInfo{Name: "test", Template: ".sd+1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stopped after moving the old version aside, with a partial new one
+	fname := path.Join(dir, "test.json")
+	os.Rename(fname, fname+backupSuffix)
+	os.WriteFile(fname+tempSuffix, []byte(`{"Name":"te`), 0666)
+	pis, err := store.LoadAllPools()
+	if err != nil || len(pis) != 1 || pis[0].Template != ".sd+1" {
+		t.Errorf("Got %v, %v", pis, err)
+	}
+}
+
+func TestJsonFileStoreLegacy(t *testing.T) {
+	dir := t.TempDir()
+	// files written before checksums were added
+	os.WriteFile(path.Join(dir, "test"), []byte(`{"Name":"test","Template":".sd+3"}`+"\n"), 0666)
+	store := NewJsonFileStore(dir)
+	pis, err := store.LoadAllPools()
+	if err != nil || len(pis) != 1 || pis[0].Template != ".sd+3" {
+		t.Errorf("Got %v, %v", pis, err)
+	}
+}
+
+func TestJsonFileStoreQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	store := NewJsonFileStore(dir)
+	store.SavePool("good", PoolInfo{Name: "good", Template: ".sd+1"})
+	store.SavePool("bad", PoolInfo{Name: "bad", Template: ".bad+1"})
+	data, _ := os.ReadFile(path.Join(dir, "good.json"))
+	os.WriteFile(path.Join(dir, "good~"), data, 0666)
+	os.WriteFile(path.Join(dir, ".good.swp"), []byte("swap"), 0666)
+	os.WriteFile(path.Join(dir, "notes"), []byte("not a pool"), 0666)
+	// and a tombstone which cannot be read
+	store.DeletePool("gone", Tombstone{Name: "gone", Template: ".sd+1"})
+	store.DeletePool("old", Tombstone{Name: "old", Template: ".sd+1"})
+	os.WriteFile(path.Join(dir, tombstoneDir, "old.json"), []byte("{"), 0666)
+
+	pg := NewPoolGroup()
+	err := pg.LoadPoolsFromStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := pg.AllPools(); len(names) != 1 || names[0] != "good" {
+		t.Errorf("Got %v", names)
+	}
+	if tombs := pg.AllTombstones(); len(tombs) != 1 || tombs[0].Name != "gone" {
+		t.Errorf("Got %v", tombs)
+	}
+	skipped := pg.Skipped()
+	if len(skipped) != 3 || skipped[0].Name != "old" || !skipped[0].Tombstone ||
+		skipped[1].Name != "notes" || skipped[2].Name != "bad" {
+		t.Fatalf("Got %v", skipped)
+	}
+	for _, rec := range skipped {
+		if _, err := os.Stat(rec.Quarantine); err != nil {
+			t.Errorf("%s was not quarantined: %v", rec.Name, err)
+		}
+	}
+	for _, fname := range []string{"notes", "bad.json", path.Join(tombstoneDir, "old.json")} {
+		if _, err := os.Stat(path.Join(dir, fname)); !os.IsNotExist(err) {
+			t.Errorf("%s was not moved: %v", fname, err)
+		}
+	}
+	// stray files are left alone
+	if _, err := os.Stat(path.Join(dir, "good~")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJsonFileStoreNames(t *testing.T) {
+	dir := t.TempDir()
+	store := NewJsonFileStore(dir)
+	for _, name := range []string{"a/b", "a_b", "a..b", ".a"} {
+		err := store.SavePool(name, PoolInfo{Name: name, Template: ".sd+1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pis, err := store.LoadAllPools()
+	if err != nil || len(pis) != 4 {
+		t.Errorf("Got %v, %v", pis, err)
+	}
+	if name := decodeName(encodeName("a/b é") + poolExt); name != "a/b é" {
+		t.Errorf("Got %q", name)
+	}
+}
+
+func TestJsonFileStoreLegacyNames(t *testing.T) {
+	dir := t.TempDir()
+	// the files of the pool "a/b" from before names were encoded
+	os.WriteFile(path.Join(dir, "a_b"), []byte(`{"Name":"a/b","Template":".sd+3"}`+"\n"), 0666)
+	os.MkdirAll(path.Join(dir, bindingDir, "a_b"), 0777)
+	os.WriteFile(path.Join(dir, bindingDir, "a_b", "2"), []byte(`{"target":"http://example.org/"}`+"\n"), 0666)
+
+	store := NewJsonFileStore(dir)
+	pis, err := store.LoadAllPools()
+	if err != nil || len(pis) != 1 || pis[0].Name != "a/b" {
+		t.Fatalf("Got %v, %v", pis, err)
+	}
+	if _, err := os.Stat(path.Join(dir, "a%2Fb.json")); err != nil {
+		t.Error(err)
+	}
+	b, err := store.LoadBinding("a/b", "2")
+	if err != nil || b["target"] != "http://example.org/" {
+		t.Errorf("Got %v, %v", b, err)
+	}
+	// the files are only renamed once
+	pis, err = store.LoadAllPools()
+	if err != nil || len(pis) != 1 {
+		t.Errorf("Got %v, %v", pis, err)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// pgStore keeps pools in a PostgreSQL database. It uses the same columns
+// as dbStore, but Postgres placeholders and upserts.
+type pgStore struct {
+	DB    *sql.DB
+	mints *mintTable
+}
+
+const pgSchema = `CREATE TABLE IF NOT EXISTS noids (
+name TEXT PRIMARY KEY,
+template TEXT,
+closed BOOLEAN,
+lastmint TEXT,
+naan TEXT,
+shoulder TEXT,
+mintkey TEXT,
+created TEXT,
+description TEXT,
+owner TEXT,
+tags TEXT,
+exclusions TEXT,
+skipped BIGINT,
+reservations TEXT,
+recycled TEXT,
+mintrecords TEXT,
+blocksize BIGINT,
+version BIGINT
+);`
+
+const pgBindingSchema = `CREATE TABLE IF NOT EXISTS noids_bindings (
+pool TEXT,
+idx TEXT,
+bindings TEXT,
+PRIMARY KEY (pool, idx)
+);`
+
+const pgMintRecordSchema = `CREATE TABLE IF NOT EXISTS noids_mintrecords (
+pool TEXT,
+keyhash TEXT,
+mintkey TEXT,
+idcount BIGINT,
+ids TEXT,
+minted TEXT,
+expires BIGINT,
+PRIMARY KEY (pool, keyhash)
+);`
+
+const pgTombstoneSchema = `CREATE TABLE IF NOT EXISTS noids_tombstones (
+name TEXT PRIMARY KEY,
+template TEXT,
+naan TEXT,
+deleted TEXT
+);`
+
+// Create a PoolStore which will serialize noid pools as
+// records in a PostgreSQL database
+func NewPostgresStore(db *sql.DB) PoolStore {
+	// create or upgrade the tables if necessary
+	_, err := upgradeSchema(db, pgMigrations)
+	if err != nil {
+		log.Printf("NewPostgresStore: %s", err.Error())
+		return nil
+	}
+	return &pgStore{DB: db, mints: newMintTable(pgRebind)}
+}
+
+// pgPlaceholders returns "$first, $first+1, ..." for n values.
+func pgPlaceholders(first, n int) string {
+	var marks []string
+	for i := first; i < first+n; i++ {
+		marks = append(marks, fmt.Sprintf("$%d", i))
+	}
+	return strings.Join(marks, ", ")
+}
+
+// pgInsert inserts the name, as $1, and the values for dbColumns as a
+// new row.
+var pgInsert = "INSERT INTO noids (name, " + strings.Join(dbColumns, ", ") + ", version) VALUES (" +
+	pgPlaceholders(1, len(dbColumns)+1) + ", 1)"
+
+func (d *pgStore) SavePool(name string, pi PoolInfo) error {
+	log.Println("Save (postgres)", name)
+	values, err := dbValues(pi)
+	if err != nil {
+		return err
+	}
+	var set []string
+	for _, c := range dbColumns {
+		set = append(set, c+" = EXCLUDED."+c)
+	}
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(pgInsert+" ON CONFLICT (name) DO UPDATE SET "+strings.Join(set, ", ")+
+		", version = COALESCE(noids.version, 0) + 1", append([]interface{}{name}, values...)...)
+	if err == nil {
+		err = d.mints.save(tx, name, pi.MintRecords)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err == nil {
+		d.mints.mark(name, pi.MintRecords)
+	}
+	return err
+}
+
+// Lock keeps other servers from using the database while this one does.
+func (d *pgStore) Lock() (func(), error) {
+	return takeLeaseLock(d.DB, pgRebind)
+}
+
+// pgRebind changes the "?" placeholders in query into "$1", "$2", ...
+func pgRebind(query string) string {
+	parts := strings.Split(query, "?")
+	for i := 1; i < len(parts); i++ {
+		parts[i] = fmt.Sprintf("$%d", i) + parts[i]
+	}
+	return strings.Join(parts, "")
+}
+
+func (d *pgStore) LoadAllPools() ([]PoolInfo, error) {
+	return dbLoadAllPools(d.DB, d.mints)
+}
+
+func (d *pgStore) DeletePool(name string, tomb Tombstone) error {
+	log.Println("Delete (postgres)", name)
+	deletedText, err := tomb.Deleted.MarshalText()
+	if err != nil {
+		return err
+	}
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO noids_tombstones (name, template, naan, deleted) VALUES ($1, $2, $3, $4)", name, tomb.Template, tomb.NAAN, string(deletedText))
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM noids_bindings WHERE pool = $1", name)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM noids_mintrecords WHERE pool = $1", name)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM noids WHERE name = $1", name)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *pgStore) LoadAllTombstones() ([]Tombstone, error) {
+	return dbLoadAllTombstones(d.DB)
+}
+
+func (d *pgStore) SaveBinding(name, index string, b map[string]string) error {
+	log.Println("Save binding (postgres)", name, index)
+	if len(b) == 0 {
+		_, err := d.DB.Exec("DELETE FROM noids_bindings WHERE pool = $1 AND idx = $2", name, index)
+		return err
+	}
+	text, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	_, err = d.DB.Exec("INSERT INTO noids_bindings (pool, idx, bindings) VALUES ($1, $2, $3) ON CONFLICT (pool, idx) DO UPDATE SET bindings = EXCLUDED.bindings", name, index, string(text))
+	return err
+}
+
+func (d *pgStore) LoadBinding(name, index string) (map[string]string, error) {
+	var text string
+	err := d.DB.QueryRow("SELECT bindings FROM noids_bindings WHERE pool = $1 AND idx = $2", name, index).Scan(&text)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var b map[string]string
+	err = json.Unmarshal([]byte(text), &b)
+	return b, err
+}
+
+// sharedPgStore is a pgStore which several servers may share, in the
+// same way as a sharedDbStore.
+type sharedPgStore struct {
+	*pgStore
+}
+
+// Create a SharedStore which will serialize noid pools as records in a
+// PostgreSQL database, which may be shared with other servers.
+func NewSharedPostgresStore(db *sql.DB) PoolStore {
+	ps := NewPostgresStore(db)
+	if ps == nil {
+		return nil
+	}
+	return &sharedPgStore{pgStore: ps.(*pgStore)}
+}
+
+func (d *sharedPgStore) LoadPool(name string) (PoolInfo, int64, error) {
+	pi, version, err := scanPool(d.DB.QueryRow(dbSelect+" WHERE name = $1", name))
+	if err == sql.ErrNoRows {
+		err = NoSuchPool
+	}
+	if err != nil {
+		return pi, version, err
+	}
+	records, err := d.mints.load(d.DB, name)
+	pi.MintRecords = append(pi.MintRecords, records[name]...)
+	return pi, version, err
+}
+
+func (d *sharedPgStore) SavePoolVersion(name string, pi PoolInfo, version int64) (int64, error) {
+	log.Println("Save (shared postgres)", name, version)
+	values, err := dbValues(pi)
+	if err != nil {
+		return 0, err
+	}
+	var set []string
+	for i, c := range dbColumns {
+		set = append(set, fmt.Sprintf("%s = $%d", c, i+1))
+	}
+	n := len(dbColumns)
+	values = append(values, version+1, name, version)
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(fmt.Sprintf("UPDATE noids SET %s, version = $%d WHERE name = $%d AND COALESCE(version, 0) = $%d",
+		strings.Join(set, ", "), n+1, n+2, n+3), values...)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	nrows, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if nrows == 0 {
+		tx.Rollback()
+		// either the pool was deleted, or someone else saved it
+		_, _, err = d.LoadPool(name)
+		if err == nil {
+			err = VersionConflict
+		}
+		return 0, err
+	}
+	err = d.mints.save(tx, name, pi.MintRecords)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	d.mints.mark(name, pi.MintRecords)
+	return version + 1, nil
+}
+
+func (d *sharedPgStore) InsertPool(name string, pi PoolInfo) error {
+	log.Println("Insert (shared postgres)", name)
+	var n int
+	err := d.DB.QueryRow("SELECT COUNT(*) FROM noids_tombstones WHERE name = $1", name).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return NameUsed
+	}
+	values, err := dbValues(pi)
+	if err != nil {
+		return err
+	}
+	result, err := d.DB.Exec(pgInsert+" ON CONFLICT (name) DO NOTHING", append([]interface{}{name}, values...)...)
+	if err != nil {
+		return err
+	}
+	nrows, err := result.RowsAffected()
+	if err == nil && nrows == 0 {
+		err = NameExists
+	}
+	return err
+}
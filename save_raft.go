@@ -0,0 +1,520 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// A raftStore replicates pools between several noids servers using an
+// embedded Raft log. Every save is a log entry, which is applied to a copy
+// of the pools kept in memory on each server once a majority of the
+// servers have it. Only the leader may save, so only the leader may mint.
+//
+// The raftStore is a SharedStore, so a server which becomes the leader
+// reloads each pool before changing it.
+type raftStore struct {
+	raft  *raft.Raft
+	fsm   *raftFSM
+	peers []RaftPeer
+	close func() error
+	done  chan struct{}
+	mints mintMarks
+
+	m sync.Mutex
+	// set once this server is the leader and has applied every
+	// entry in the log
+	ready bool
+}
+
+// RaftConfig describes one server in a Raft cluster.
+type RaftConfig struct {
+	ID    string     // the name of this server, which must be in Peers
+	Addr  string     // the host:port to use for Raft traffic
+	Dir   string     // the directory to keep the Raft log and snapshots
+	Peers []RaftPeer // every server in the cluster
+}
+
+// A RaftPeer is a server in a Raft cluster. URL is where its API is
+// served, and requests to other servers are redirected there while it
+// is the leader.
+type RaftPeer struct {
+	ID, Addr, URL string
+}
+
+var (
+	NoLeader = errors.New("The cluster has no leader")
+
+	// how long to wait for a log entry to be applied
+	raftTimeout = 10 * time.Second
+)
+
+// ParseRaftPeers reads a list of peers of the form
+// "id=host:port=url,id=host:port=url,...".
+func ParseRaftPeers(s string) ([]RaftPeer, error) {
+	var peers []RaftPeer
+	for _, p := range strings.Split(s, ",") {
+		fields := strings.SplitN(p, "=", 3)
+		if len(fields) != 3 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("Raft peer %q is not of the form id=host:port=url", p)
+		}
+		peers = append(peers, RaftPeer{ID: fields[0], Addr: fields[1], URL: fields[2]})
+	}
+	return peers, nil
+}
+
+// NewRaftStore starts this server's part of a Raft cluster. The cluster
+// is started the first time, and afterwards the servers use the log kept
+// in Dir.
+func NewRaftStore(cfg RaftConfig) (PoolStore, error) {
+	addr, err := net.ResolveTCPAddr("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	trans, err := raft.NewTCPTransport(cfg.Addr, addr, 3, raftTimeout, log.Writer())
+	if err != nil {
+		return nil, err
+	}
+	rs, err := newRaftStore(cfg, raft.DefaultConfig(), trans)
+	if err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// newRaftStore starts the raft store using trans, which is closed when
+// the store is, or if it cannot be started.
+func newRaftStore(cfg RaftConfig, rc *raft.Config, trans raft.Transport) (*raftStore, error) {
+	rc.LocalID = raft.ServerID(cfg.ID)
+	rc.LogOutput = log.Writer()
+	logs, err := raftboltdb.NewBoltStore(filepath.Join(cfg.Dir, "raft.db"))
+	if err != nil {
+		closeTransport(trans)
+		return nil, err
+	}
+	snaps, err := raft.NewFileSnapshotStore(cfg.Dir, 2, log.Writer())
+	if err != nil {
+		logs.Close()
+		closeTransport(trans)
+		return nil, err
+	}
+	fsm := newRaftFSM()
+	r, err := raft.NewRaft(rc, fsm, logs, logs, snaps, trans)
+	if err != nil {
+		logs.Close()
+		closeTransport(trans)
+		return nil, err
+	}
+	var servers []raft.Server
+	for _, p := range cfg.Peers {
+		servers = append(servers, raft.Server{ID: raft.ServerID(p.ID), Address: raft.ServerAddress(p.Addr)})
+	}
+	err = r.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+	if err != nil && err != raft.ErrCantBootstrap {
+		r.Shutdown().Error()
+		logs.Close()
+		closeTransport(trans)
+		return nil, err
+	}
+	rs := &raftStore{
+		raft:  r,
+		fsm:   fsm,
+		peers: cfg.Peers,
+		done:  make(chan struct{}),
+	}
+	go rs.watchLeader()
+	rs.close = func() error {
+		close(rs.done)
+		err := r.Shutdown().Error()
+		if err2 := logs.Close(); err == nil {
+			err = err2
+		}
+		if err2 := closeTransport(trans); err == nil {
+			err = err2
+		}
+		return err
+	}
+	return rs, nil
+}
+
+// closeTransport stops listening for the other servers. Raft closes its
+// transport when it is shut down, but not if it failed to start.
+func closeTransport(trans raft.Transport) error {
+	if c, ok := trans.(raft.WithClose); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Close stops this server's part of the cluster.
+func (rs *raftStore) Close() error {
+	return rs.close()
+}
+
+// watchLeader keeps track of whether this server is the leader. A new
+// leader waits until it has applied every entry in the log, so that the
+// pools it hands out are current.
+func (rs *raftStore) watchLeader() {
+	for {
+		select {
+		case <-rs.done:
+			return
+		case leader := <-rs.raft.LeaderCh():
+			if leader {
+				err := rs.raft.Barrier(raftTimeout).Error()
+				leader = err == nil
+				if err != nil {
+					log.Println("Error becoming raft leader:", err)
+				}
+			}
+			rs.m.Lock()
+			rs.ready = leader
+			rs.m.Unlock()
+		}
+	}
+}
+
+// LeaderURL returns the URL of the leader's API, and whether this server
+// is the leader. The URL is empty if there is no leader, or if this server
+// has just become the leader and is not ready.
+func (rs *raftStore) LeaderURL() (string, bool) {
+	if rs.raft.State() == raft.Leader {
+		rs.m.Lock()
+		defer rs.m.Unlock()
+		return "", rs.ready
+	}
+	_, id := rs.raft.LeaderWithID()
+	for _, p := range rs.peers {
+		if raft.ServerID(p.ID) == id {
+			return p.URL, false
+		}
+	}
+	return "", false
+}
+
+// apply adds cmd to the log and waits until it has been applied.
+func (rs *raftStore) apply(cmd raftCommand) (int64, error) {
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		return 0, err
+	}
+	f := rs.raft.Apply(b, raftTimeout)
+	if err := f.Error(); err != nil {
+		if err == raft.ErrNotLeader {
+			err = NoLeader
+		}
+		return 0, err
+	}
+	result := f.Response().(raftResult)
+	return result.Version, result.Err
+}
+
+func (rs *raftStore) SavePool(name string, pi PoolInfo) error {
+	log.Println("Save (raft)", name)
+	recs := pi.MintRecords
+	pi.MintRecords = nil
+	_, err := rs.apply(raftCommand{Op: "save", Name: name, Pool: &pi})
+	if err != nil {
+		return err
+	}
+	return rs.saveMintRecords(name, recs)
+}
+
+func (rs *raftStore) SavePoolVersion(name string, pi PoolInfo, version int64) (int64, error) {
+	log.Println("Save (raft)", name, version)
+	recs := pi.MintRecords
+	pi.MintRecords = nil
+	version, err := rs.apply(raftCommand{Op: "save", Name: name, Pool: &pi, Version: version, Check: true})
+	if err != nil {
+		return 0, err
+	}
+	return version, rs.saveMintRecords(name, recs)
+}
+
+func (rs *raftStore) InsertPool(name string, pi PoolInfo) error {
+	log.Println("Insert (raft)", name)
+	recs := pi.MintRecords
+	pi.MintRecords = nil
+	_, err := rs.apply(raftCommand{Op: "insert", Name: name, Pool: &pi})
+	if err != nil {
+		return err
+	}
+	return rs.saveMintRecords(name, recs)
+}
+
+// saveMintRecords adds an entry to the log with the records in recs which
+// have not been saved. It follows the entry saving the pool, so a record
+// is never saved for ids the pool could mint again.
+func (rs *raftStore) saveMintRecords(name string, recs []MintRecord) error {
+	recs = rs.mints.unsaved(name, recs)
+	if len(recs) == 0 {
+		return nil
+	}
+	// every server removes the same expired records
+	_, err := rs.apply(raftCommand{Op: "mint", Name: name, Records: recs, Cutoff: mintRecordCutoff()})
+	if err == nil {
+		rs.mints.mark(name, recs)
+	}
+	return err
+}
+
+func (rs *raftStore) DeletePool(name string, tomb Tombstone) error {
+	log.Println("Delete (raft)", name)
+	_, err := rs.apply(raftCommand{Op: "delete", Name: name, Tomb: &tomb})
+	return err
+}
+
+func (rs *raftStore) SaveBinding(name, index string, b map[string]string) error {
+	log.Println("Save binding (raft)", name, index)
+	_, err := rs.apply(raftCommand{Op: "bind", Name: name, Index: index, Bindings: b})
+	return err
+}
+
+func (rs *raftStore) LoadPool(name string) (PoolInfo, int64, error) {
+	pi, version, err := rs.fsm.loadPool(name)
+	rs.mints.mark(name, pi.MintRecords)
+	return pi, version, err
+}
+
+func (rs *raftStore) LoadAllPools() ([]PoolInfo, error) {
+	pis, err := rs.fsm.loadAllPools()
+	for _, pi := range pis {
+		rs.mints.mark(pi.Name, pi.MintRecords)
+	}
+	return pis, err
+}
+
+func (rs *raftStore) LoadAllTombstones() ([]Tombstone, error) {
+	rs.fsm.RLock()
+	defer rs.fsm.RUnlock()
+	var tombs []Tombstone
+	for _, tomb := range rs.fsm.Tombs {
+		tombs = append(tombs, tomb)
+	}
+	return tombs, nil
+}
+
+func (rs *raftStore) LoadBinding(name, index string) (map[string]string, error) {
+	rs.fsm.RLock()
+	defer rs.fsm.RUnlock()
+	return copyTags(rs.fsm.Bindings[name][index]), nil
+}
+
+// A raftCommand is an entry in the Raft log.
+type raftCommand struct {
+	Op       string // one of "save", "insert", "delete", "bind", or "mint"
+	Name     string
+	Pool     *PoolInfo         `json:",omitempty"`
+	Version  int64             `json:",omitempty"`
+	Check    bool              `json:",omitempty"` // save only if the pool is at Version
+	Tomb     *Tombstone        `json:",omitempty"`
+	Index    string            `json:",omitempty"`
+	Bindings map[string]string `json:",omitempty"`
+	Records  []MintRecord      `json:",omitempty"`
+	Cutoff   string            `json:",omitempty"` // remove records with earlier names
+}
+
+// raftResult is the result of applying a raftCommand.
+type raftResult struct {
+	Version int64
+	Err     error
+}
+
+// raftFSM holds the pools as of the last log entry applied. Pools are
+// kept as JSON, so the pools handed out never share memory with it. The
+// mint records of each pool are kept by mintRecordName().
+type raftFSM struct {
+	sync.RWMutex
+	Pools       map[string]raftPool
+	Tombs       map[string]Tombstone
+	Bindings    map[string]map[string]map[string]string
+	MintRecords map[string]map[string]MintRecord
+}
+
+type raftPool struct {
+	Info    json.RawMessage
+	Version int64
+}
+
+func newRaftFSM() *raftFSM {
+	return &raftFSM{
+		Pools:    make(map[string]raftPool),
+		Tombs:    make(map[string]Tombstone),
+		Bindings: make(map[string]map[string]map[string]string),
+
+		MintRecords: make(map[string]map[string]MintRecord),
+	}
+}
+
+func (f *raftFSM) Apply(l *raft.Log) interface{} {
+	var cmd raftCommand
+	err := json.Unmarshal(l.Data, &cmd)
+	if err != nil {
+		log.Printf("Error reading raft log entry %d: %s", l.Index, err.Error())
+		return raftResult{Err: err}
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	current, exists := f.Pools[cmd.Name]
+	switch cmd.Op {
+	case "insert":
+		if _, ok := f.Tombs[cmd.Name]; ok {
+			return raftResult{Err: NameUsed}
+		}
+		if exists {
+			return raftResult{Err: NameExists}
+		}
+		fallthrough
+	case "save":
+		if cmd.Check && !exists {
+			return raftResult{Err: NoSuchPool}
+		}
+		if cmd.Check && current.Version != cmd.Version {
+			return raftResult{Err: VersionConflict}
+		}
+		info, err := json.Marshal(cmd.Pool)
+		if err != nil {
+			return raftResult{Err: err}
+		}
+		f.Pools[cmd.Name] = raftPool{Info: info, Version: current.Version + 1}
+		return raftResult{Version: current.Version + 1}
+	case "delete":
+		f.Tombs[cmd.Name] = *cmd.Tomb
+		delete(f.Pools, cmd.Name)
+		delete(f.Bindings, cmd.Name)
+		delete(f.MintRecords, cmd.Name)
+	case "bind":
+		if len(cmd.Bindings) == 0 {
+			delete(f.Bindings[cmd.Name], cmd.Index)
+			break
+		}
+		if f.Bindings[cmd.Name] == nil {
+			f.Bindings[cmd.Name] = make(map[string]map[string]string)
+		}
+		f.Bindings[cmd.Name][cmd.Index] = cmd.Bindings
+	case "mint":
+		if !exists {
+			return raftResult{Err: NoSuchPool}
+		}
+		recs := f.MintRecords[cmd.Name]
+		if recs == nil {
+			recs = make(map[string]MintRecord)
+			f.MintRecords[cmd.Name] = recs
+		}
+		for _, rec := range cmd.Records {
+			recs[mintRecordName(rec)] = rec
+		}
+		for k := range recs {
+			if k < cmd.Cutoff {
+				delete(recs, k)
+			}
+		}
+	default:
+		return raftResult{Err: fmt.Errorf("Unknown raft command %q", cmd.Op)}
+	}
+	return raftResult{}
+}
+
+func (f *raftFSM) loadPool(name string) (PoolInfo, int64, error) {
+	f.RLock()
+	defer f.RUnlock()
+	var pi PoolInfo
+	rp, ok := f.Pools[name]
+	if !ok {
+		return pi, 0, NoSuchPool
+	}
+	err := json.Unmarshal(rp.Info, &pi)
+	pi.MintRecords = append(pi.MintRecords, f.mintRecords(name)...)
+	return pi, rp.Version, err
+}
+
+// mintRecords returns the mint records of the pool `name`, oldest first.
+// expects the caller to be holding the lock on f
+func (f *raftFSM) mintRecords(name string) []MintRecord {
+	var keys []string
+	for k := range f.MintRecords[name] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var recs []MintRecord
+	for _, k := range keys {
+		recs = append(recs, f.MintRecords[name][k])
+	}
+	return recs
+}
+
+func (f *raftFSM) loadAllPools() ([]PoolInfo, error) {
+	f.RLock()
+	defer f.RUnlock()
+	var (
+		pis     []PoolInfo
+		skipped SkippedRecords
+	)
+	for name, rp := range f.Pools {
+		var pi PoolInfo
+		err := json.Unmarshal(rp.Info, &pi)
+		if err != nil {
+			skipped = append(skipped, SkippedRecord{Name: name, Error: err.Error()})
+			continue
+		}
+		pi.MintRecords = append(pi.MintRecords, f.mintRecords(name)...)
+		pis = append(pis, pi)
+	}
+	if len(skipped) > 0 {
+		return pis, skipped
+	}
+	return pis, nil
+}
+
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.RLock()
+	defer f.RUnlock()
+	b, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	return raftSnapshot(b), nil
+}
+
+func (f *raftFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	restored := newRaftFSM()
+	err := json.NewDecoder(rc).Decode(restored)
+	if err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.Pools = restored.Pools
+	f.Tombs = restored.Tombs
+	f.Bindings = restored.Bindings
+	f.MintRecords = restored.MintRecords
+	return nil
+}
+
+// raftSnapshot is the JSON encoding of a raftFSM.
+type raftSnapshot []byte
+
+func (s raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	_, err := sink.Write(s)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s raftSnapshot) Release() {}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// startRaftCluster starts n servers on localhost with short timeouts
+func startRaftCluster(t *testing.T, n int) []*raftStore {
+	var (
+		peers  []RaftPeer
+		transs []raft.Transport
+	)
+	for i := 0; i < n; i++ {
+		trans, err := raft.NewTCPTransport("127.0.0.1:0", nil, 3, time.Second, nil)
+		if err != nil {
+			t.Skip(err)
+		}
+		// in case the cluster does not start
+		t.Cleanup(func() { trans.Close() })
+		transs = append(transs, trans)
+		peers = append(peers, RaftPeer{
+			ID:   fmt.Sprintf("node%d", i),
+			Addr: string(trans.LocalAddr()),
+			URL:  fmt.Sprintf("http://node%d", i),
+		})
+	}
+	var stores []*raftStore
+	for i, trans := range transs {
+		rc := raft.DefaultConfig()
+		rc.HeartbeatTimeout = 100 * time.Millisecond
+		rc.ElectionTimeout = 100 * time.Millisecond
+		rc.LeaderLeaseTimeout = 100 * time.Millisecond
+		rc.CommitTimeout = 5 * time.Millisecond
+		rs, err := newRaftStore(RaftConfig{ID: peers[i].ID, Dir: t.TempDir(), Peers: peers}, rc, trans)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores = append(stores, rs)
+	}
+	return stores
+}
+
+// waitForLeader returns the leader among stores
+func waitForLeader(t *testing.T, stores []*raftStore) *raftStore {
+	for i := 0; i < 500; i++ {
+		for _, rs := range stores {
+			if _, leader := rs.LeaderURL(); leader {
+				return rs
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no leader was elected")
+	return nil
+}
+
+func TestRaftStoreFailed(t *testing.T) {
+	trans, err := raft.NewTCPTransport("127.0.0.1:0", nil, 3, time.Second, nil)
+	if err != nil {
+		t.Skip(err)
+	}
+	addr := string(trans.LocalAddr())
+	// the raft directory cannot be made
+	dir := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(dir, nil, 0666)
+	_, err = newRaftStore(RaftConfig{ID: "node0", Dir: dir}, raft.DefaultConfig(), trans)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		t.Errorf("%s is still listening", addr)
+	}
+}
+
+func TestRaftStore(t *testing.T) {
+	stores := startRaftCluster(t, 3)
+	defer func() {
+		DefaultStore = NullStore{}
+		for _, rs := range stores {
+			rs.Close()
+		}
+	}()
+
+	leader := waitForLeader(t, stores)
+	DefaultStore = leader
+	pg := NewPoolGroup()
+	_, err := pg.AddPool("test", ".sddd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := pg.PoolMint("test", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyed, err := pg.PoolMintKey("test", "abc", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the mint record has its own log entry
+	leader.fsm.RLock()
+	info := string(leader.fsm.Pools["test"].Info)
+	leader.fsm.RUnlock()
+	if strings.Contains(info, "MintRecords") {
+		t.Errorf("Expected the mint records to be kept apart, got %s", info)
+	}
+
+	// followers redirect to the leader, and cannot save
+	var followers []*raftStore
+	for _, rs := range stores {
+		if rs != leader {
+			followers = append(followers, rs)
+		}
+	}
+	url, _ := followers[0].LeaderURL()
+	leaderURL, _ := leader.LeaderURL()
+	if url == "" || leaderURL != "" {
+		t.Errorf("Got leader URL %q", url)
+	}
+	err = followers[0].SavePool("other", PoolInfo{Name: "other", Template: ".sd+0"})
+	if err != NoLeader {
+		t.Errorf("Expected NoLeader, got %v", err)
+	}
+
+	// a new leader carries on from where the old one stopped
+	addr, _ := leader.raft.LeaderWithID()
+	leader.Close()
+	// and the old one no longer listens for raft traffic
+	if conn, err := net.DialTimeout("tcp", string(addr), time.Second); err == nil {
+		conn.Close()
+		t.Errorf("%s is still listening", addr)
+	}
+	stores = followers
+	leader = waitForLeader(t, stores)
+	DefaultStore = leader
+	pg = NewPoolGroup()
+	err = pg.LoadPoolsFromStore(leader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := pg.PoolMint("test", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := pg.PoolMintKey("test", "abc", 2)
+	if err != nil || !reflect.DeepEqual(again, keyed) {
+		t.Errorf("Expected %v, got %v, %v", keyed, again, err)
+	}
+	seen := make(map[string]bool)
+	for _, id := range append(append(first, keyed...), next...) {
+		if seen[id] {
+			t.Errorf("%s was minted twice", id)
+		}
+		seen[id] = true
+	}
+	pi, err := pg.GetPool("test")
+	if err != nil || pi.Used.Int64() != 22 {
+		t.Errorf("Got %v, %v", pi, err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// A dbMigration changes the schema of a database from one version to the
+// next, by creating a table or adding columns to one. A migration may be
+// applied again, e.g. to a database made before schema versions were
+// kept: the table is only created if it is missing, and so are the columns.
+type dbMigration struct {
+	create  string   // a CREATE TABLE IF NOT EXISTS statement
+	table   string   // the table to add columns to
+	columns []string // the columns to add, as "name TYPE"
+	mysql   string   // a statement only run on MySQL
+}
+
+// dbMigrations are the changes to the schema of a MySQL or sqlite
+// database. The schema version is the number of them applied. Only add to
+// the end of the list.
+var dbMigrations = []dbMigration{
+	{create: `CREATE TABLE IF NOT EXISTS noids (
+name VARCHAR(255) PRIMARY KEY,
+template VARCHAR(255),
+closed BOOLEAN,
+lastmint VARCHAR(64)
+);`},
+	{table: "noids", columns: []string{"naan VARCHAR(64)", "shoulder VARCHAR(64)"}},
+	{table: "noids", columns: []string{"mintkey VARCHAR(128)"}},
+	{create: dbTombstoneSchema},
+	{table: "noids", columns: []string{"created VARCHAR(64)", "description TEXT", "owner VARCHAR(255)", "tags TEXT"}},
+	{table: "noids", columns: []string{"exclusions TEXT", "skipped BIGINT"}},
+	{create: dbBindingSchema},
+	{table: "noids", columns: []string{"reservations MEDIUMTEXT", "recycled MEDIUMTEXT"}},
+	{table: "noids", columns: []string{"mintrecords TEXT"}},
+	{table: "noids", columns: []string{"version BIGINT"}},
+	{table: "noids", columns: []string{"blocksize BIGINT"}},
+	{create: dbLockSchema},
+	{create: dbMintRecordSchema},
+	// a TEXT column holds at most 64KB in MySQL
+	{mysql: "ALTER TABLE noids MODIFY reservations MEDIUMTEXT, MODIFY recycled MEDIUMTEXT"},
+	{table: "noids", columns: []string{"advancedto VARCHAR(255)"}},
+}
+
+// pgMigrations are the changes to the schema of a PostgreSQL database.
+var pgMigrations = []dbMigration{
+	{create: pgSchema},
+	{create: pgTombstoneSchema},
+	{create: pgBindingSchema},
+	{create: dbLockSchema},
+	{create: pgMintRecordSchema},
+	{table: "noids", columns: []string{"advancedto TEXT"}},
+}
+
+// noids_schema has a single row, with id 1, so two servers starting at
+// once cannot both add it
+const dbSchemaVersionSchema = `CREATE TABLE IF NOT EXISTS noids_schema (
+id INTEGER PRIMARY KEY,
+version INTEGER
+);`
+
+var SchemaTooNew = errors.New("The database schema is newer than this server understands")
+
+func (m dbMigration) apply(db *sql.DB) error {
+	if _, ok := db.Driver().(*mysql.MySQLDriver); ok && m.mysql != "" {
+		_, err := db.Exec(m.mysql)
+		if err != nil {
+			return err
+		}
+	}
+	if m.create != "" {
+		_, err := db.Exec(m.create)
+		if err != nil {
+			return err
+		}
+	}
+	for _, column := range m.columns {
+		name := strings.Fields(column)[0]
+		rows, err := db.Query("SELECT " + name + " FROM " + m.table + " WHERE 1 = 0")
+		if err == nil {
+			// the column is already there
+			rows.Close()
+			continue
+		}
+		_, err = db.Exec("ALTER TABLE " + m.table + " ADD COLUMN " + column)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaVersion returns the version of the schema of db. It is 0 for a
+// new database, or one made before schema versions were kept.
+func schemaVersion(db *sql.DB) (int, error) {
+	_, err := db.Exec(dbSchemaVersionSchema)
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	err = db.QueryRow("SELECT version FROM noids_schema").Scan(&version)
+	if err == sql.ErrNoRows {
+		_, err = db.Exec("INSERT INTO noids_schema (id, version) VALUES (1, 0)")
+		if err != nil {
+			// another server may have added the row first
+			err = db.QueryRow("SELECT version FROM noids_schema").Scan(&version)
+		}
+	}
+	return version, err
+}
+
+// upgradeSchema applies the migrations which db does not have yet, and
+// returns the schema version. It returns SchemaTooNew if db has a version
+// later than the migrations.
+func upgradeSchema(db *sql.DB, migrations []dbMigration) (int, error) {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return 0, err
+	}
+	if version > len(migrations) {
+		return version, fmt.Errorf("%w: it is at version %d, and this server knows up to version %d",
+			SchemaTooNew, version, len(migrations))
+	}
+	for version < len(migrations) {
+		err = migrations[version].apply(db)
+		if err != nil {
+			return version, err
+		}
+		version++
+		log.Println("Upgraded the database schema to version", version)
+		// a later version may have been set by another server
+		_, err = db.Exec(fmt.Sprintf("UPDATE noids_schema SET version = %d WHERE version < %d", version, version))
+		if err != nil {
+			return version, err
+		}
+	}
+	return version, nil
+}
+
+// dbCommand implements the db command. The only subcommand is "upgrade",
+// which upgrades the schema of the database given by the storage options
+// without starting the server. The database is opened without a store,
+// since opening a store upgrades the schema itself.
+func dbCommand(sqliteFile, mysqlLocation, pgLocation string, args []string) error {
+	if len(args) != 1 || args[0] != "upgrade" {
+		return errors.New("usage: noids [storage options] db upgrade")
+	}
+	var (
+		driver, location string
+		migrations       = dbMigrations
+	)
+	switch {
+	case sqliteFile != "":
+		driver, location = "sqlite3", sqliteFile
+	case mysqlLocation != "":
+		driver, location = "mysql", mysqlLocation
+	case pgLocation != "":
+		driver, location = "postgres", pgLocation
+		migrations = pgMigrations
+	default:
+		return errors.New("db upgrade needs a MySQL, PostgreSQL, or sqlite database")
+	}
+	db, err := sql.Open(driver, location)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	before, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	version, err := upgradeSchema(db, migrations)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Upgraded the database schema from version %d to %d\n", before, version)
+	return nil
+}
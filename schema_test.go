@@ -0,0 +1,97 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpgradeSchema(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// a database made by version 1.2.0
+	_, err = db.Exec(dbMigrations[0].create)
+	if err == nil {
+		_, err = db.Exec(`INSERT INTO noids (name, template, closed, lastmint) VALUES ('test', '.sd+3', 0, '2020-01-01T00:00:00Z')`)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := NewDbFileStore(db)
+	if ps == nil {
+		t.Fatal("could not upgrade the database")
+	}
+	pis, err := ps.LoadAllPools()
+	if err != nil || len(pis) != 1 || pis[0].Template != ".sd+3" {
+		t.Fatalf("Got %v, %v", pis, err)
+	}
+	err = ps.SavePool("test", PoolInfo{Name: "test", Template: ".sd+4", Owner: "library"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := schemaVersion(db)
+	if err != nil || version != len(dbMigrations) {
+		t.Errorf("Got %d, %v", version, err)
+	}
+
+	// the migrations may be applied again
+	_, err = db.Exec("UPDATE noids_schema SET version = 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err = upgradeSchema(db, dbMigrations)
+	if err != nil || version != len(dbMigrations) {
+		t.Errorf("Got %d, %v", version, err)
+	}
+
+	// a later server has upgraded the database
+	_, err = db.Exec("UPDATE noids_schema SET version = 1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = upgradeSchema(db, dbMigrations)
+	if !errors.Is(err, SchemaTooNew) {
+		t.Errorf("Expected SchemaTooNew, got %v", err)
+	}
+	if NewDbFileStore(db) != nil {
+		t.Errorf("Expected no store")
+	}
+}
+
+func TestDbUpgradeCommand(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "noids.db")
+	db, err := sql.Open("sqlite3", fname)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(dbMigrations[0].create)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dbCommand(fname, "", "", []string{"upgrade"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := schemaVersion(db)
+	if err != nil || version != len(dbMigrations) {
+		t.Errorf("Got %d, %v", version, err)
+	}
+	// there is only ever one version row
+	_, err = db.Exec("INSERT INTO noids_schema (id, version) VALUES (1, 0)")
+	if err == nil {
+		t.Errorf("Expected a second version row to be refused")
+	}
+
+	err = dbCommand("", "", "", []string{"upgrade"})
+	if err == nil {
+		t.Errorf("Expected an error without a database")
+	}
+}
@@ -2,11 +2,17 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/pat"
+	"github.com/ndlib/noids/noid"
 )
 
 var (
@@ -22,19 +28,47 @@ func PoolsHandler(w http.ResponseWriter, r *http.Request) {
 
 func NewPoolHandler(w http.ResponseWriter, r *http.Request) {
 	logRequest(r)
-	name := r.FormValue("name")
-	template := r.FormValue("template")
-	if name == "" || template == "" {
+	pi := PoolInfo{
+		Name:     r.FormValue("name"),
+		Template: r.FormValue("template"),
+		NAAN:     r.FormValue("naan"),
+		Shoulder: r.FormValue("shoulder"),
+
+		Description: r.FormValue("description"),
+		Owner:       r.FormValue("owner"),
+	}
+	if pi.Name == "" || pi.Template == "" {
 		http.Error(w, "missing arguments", 400)
 		return
 	}
-	pi, err := pools.AddPool(name, template)
+	tags, err := parseTags(r.Form["tag"])
+	if err != nil {
+		httpError(w, err, 400)
+		return
+	}
+	pi.Tags = tags
+	pi.Exclusions, err = parseExclusions(r.Form)
+	if err != nil {
+		httpError(w, err, 400)
+		return
+	}
+	blockSize, err := parseBlockSize(r)
+	if err != nil {
+		httpError(w, err, 400)
+		return
+	}
+	if blockSize != nil {
+		pi.BlockSize = *blockSize
+	}
+	pi, err = pools.CreatePool(pi)
 	if err != nil {
 		if err == NameExists {
 			http.Error(w, "name already exists", 409)
+		} else if err == NameUsed {
+			http.Error(w, "name belongs to a deleted pool", 409)
 		} else {
 			log.Println("Error:", err)
-			http.Error(w, err.Error(), 400)
+			httpError(w, err, 400)
 		}
 		return
 	}
@@ -48,12 +82,232 @@ func PoolShowHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		// most likely the error is that the pool name doesn't exist
 		log.Println("Error:", err)
-		http.Error(w, err.Error(), 404)
+		httpError(w, err, 404)
 		return
 	}
 	writeJSON(w, pi)
 }
 
+// PoolUpdateHandler changes the description, owner, tags, exclusions,
+// or block size of a pool.
+// Only the parameters given are changed.
+func PoolUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	name := r.FormValue(":poolname")
+	var u PoolUpdate
+	if _, ok := r.Form["description"]; ok {
+		s := r.FormValue("description")
+		u.Description = &s
+	}
+	if _, ok := r.Form["owner"]; ok {
+		s := r.FormValue("owner")
+		u.Owner = &s
+	}
+	tags, err := parseTags(r.Form["tag"])
+	if err != nil {
+		httpError(w, err, 400)
+		return
+	}
+	u.Tags = tags
+	u.Exclusions, err = parseExclusions(r.Form)
+	if err != nil {
+		httpError(w, err, 400)
+		return
+	}
+	u.BlockSize, err = parseBlockSize(r)
+	if err != nil {
+		httpError(w, err, 400)
+		return
+	}
+	pi, err := pools.UpdatePool(name, u)
+	if err != nil {
+		log.Println("Error:", err)
+		if err == NoSuchPool {
+			httpError(w, err, 404)
+		} else {
+			httpError(w, err, 400)
+		}
+		return
+	}
+	writeJSON(w, pi)
+}
+
+// parseBlockSize reads the blocksize parameter. Returns nil if it
+// was not given.
+func parseBlockSize(r *http.Request) (*int64, error) {
+	if _, ok := r.Form["blocksize"]; !ok {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(r.FormValue("blocksize"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("blocksize %q is not a number", r.FormValue("blocksize"))
+	}
+	if n < 0 {
+		return nil, BadBlockSize
+	}
+	return &n, nil
+}
+
+// parseTags turns a list of "key=value" strings into a map.
+func parseTags(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	tags := make(map[string]string)
+	for _, v := range values {
+		i := strings.Index(v, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("tag %q is not of the form key=value", v)
+		}
+		tags[v[:i]] = v[i+1:]
+	}
+	return tags, nil
+}
+
+// parseExclusions reads the exclude, excludePattern, and excludeWords
+// parameters. It returns nil if none of them were given. Empty values are
+// ignored, so e.g. "exclude=" gives an empty exclusion list.
+func parseExclusions(form url.Values) (*Exclusions, error) {
+	_, ok1 := form["exclude"]
+	_, ok2 := form["excludePattern"]
+	_, ok3 := form["excludeWords"]
+	if !ok1 && !ok2 && !ok3 {
+		return nil, nil
+	}
+	e := &Exclusions{}
+	for _, id := range form["exclude"] {
+		if id != "" {
+			e.Ids = append(e.Ids, id)
+		}
+	}
+	for _, pattern := range form["excludePattern"] {
+		if pattern != "" {
+			e.Patterns = append(e.Patterns, pattern)
+		}
+	}
+	if s := form.Get("excludeWords"); s != "" {
+		words, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("excludeWords must be true or false")
+		}
+		e.Words = words
+	}
+	return e, nil
+}
+
+// IdShowHandler returns the bindings of a minted id.
+func IdShowHandler(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	b, err := pools.GetBindings(r.FormValue(":poolname"), r.FormValue(":id"))
+	if err != nil {
+		bindingError(w, err)
+		return
+	}
+	if b == nil {
+		b = map[string]string{}
+	}
+	writeJSON(w, b)
+}
+
+// IdBindHandler sets the bindings of a minted id. Every parameter is
+// taken to be a binding, and a parameter with an empty value removes
+// that binding.
+func IdBindHandler(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	name := r.FormValue(":poolname")
+	id := r.FormValue(":id")
+	changes := make(map[string]string)
+	for k := range r.Form {
+		// skip the route variables
+		if strings.HasPrefix(k, ":") {
+			continue
+		}
+		changes[k] = r.Form.Get(k)
+	}
+	if target := changes["target"]; target != "" && !validTarget(target) {
+		http.Error(w, "target must be an absolute http or https URL", 400)
+		return
+	}
+	b, err := pools.SetBindings(name, id, changes)
+	if err != nil {
+		bindingError(w, err)
+		return
+	}
+	if b == nil {
+		b = map[string]string{}
+	}
+	writeJSON(w, b)
+}
+
+// ResolveHandler redirects to the URL bound to an id as its target.
+func ResolveHandler(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	b, err := pools.GetBindings(r.FormValue(":poolname"), r.FormValue(":id"))
+	if err != nil {
+		bindingError(w, err)
+		return
+	}
+	target := b["target"]
+	if target == "" {
+		http.Error(w, "id has no target", 404)
+		return
+	}
+	if !validTarget(target) {
+		// e.g. bound before targets were checked
+		http.Error(w, "id has no valid target", 404)
+		return
+	}
+	http.Redirect(w, r, target, 302)
+}
+
+// validTarget is true if target is an absolute http or https URL, so a
+// resolver only ever redirects to another site, and never to a path on
+// this one.
+func validTarget(target string) bool {
+	u, err := url.Parse(target)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func bindingError(w http.ResponseWriter, err error) {
+	log.Println("Error:", err)
+	switch err.(type) {
+	case *noid.IdError:
+		httpError(w, err, 400)
+		return
+	}
+	switch err {
+	case NoSuchPool, NotMinted:
+		httpError(w, err, 404)
+	default:
+		httpError(w, err, 500)
+	}
+}
+
+// PoolDeleteHandler deletes a closed pool, and returns its tombstone.
+func PoolDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	name := r.FormValue(":poolname")
+	tomb, err := pools.DeletePool(name)
+	if err != nil {
+		log.Println("Error:", err)
+		switch err {
+		case NoSuchPool:
+			httpError(w, err, 404)
+		case PoolOpen:
+			httpError(w, err, 403)
+		default:
+			httpError(w, err, 500)
+		}
+		return
+	}
+	writeJSON(w, tomb)
+}
+
+func TombstonesHandler(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	writeJSON(w, pools.AllTombstones())
+}
+
 func PoolOpenHandler(w http.ResponseWriter, r *http.Request) {
 	handleOpenClose(w, r, false)
 }
@@ -68,42 +322,130 @@ func handleOpenClose(w http.ResponseWriter, r *http.Request, makeClosed bool) {
 	pi, err := pools.SetPoolState(name, makeClosed)
 	if err != nil {
 		log.Println("Error:", err)
-		http.Error(w, err.Error(), 403)
+		httpError(w, err, 403)
 		return
 	}
 	writeJSON(w, pi)
 }
 
-func MintHandler(w http.ResponseWriter, r *http.Request) {
-	logRequest(r)
+// mintCount returns the value of the parameter n, which should be
+// between 1 and 1000, and defaults to 1.
+func mintCount(r *http.Request) (int, error) {
 	var count int = 1
 	var err error
 
-	name := r.FormValue(":poolname")
 	n := r.FormValue("n")
-
 	if n != "" {
 		count, err = strconv.Atoi(n)
 		if err != nil {
-			http.Error(w, err.Error(), 400)
-			return
+			return 0, err
 		}
 		if count <= 0 || count > 1000 {
-			http.Error(w, "count is out of range", 400)
-			return
+			return 0, errors.New("count is out of range")
 		}
 	}
+	return count, nil
+}
+
+func MintHandler(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
 
-	ids, err := pools.PoolMint(name, count)
+	name := r.FormValue(":poolname")
+	count, err := mintCount(r)
+	if err != nil {
+		httpError(w, err, 400)
+		return
+	}
+
+	// a repeated request with the same key gets the same ids
+	key := r.Header.Get("Idempotency-Key")
+	ids, err := pools.PoolMintKey(name, key, count)
 	if err != nil {
 		log.Println("Error:", err)
-		http.Error(w, err.Error(), 400)
+		if err == KeyReused {
+			httpError(w, err, 422)
+		} else {
+			httpError(w, err, 400)
+		}
 		return
 	}
 	log.Println("Minted", ids)
 	writeJSON(w, ids)
 }
 
+// ReserveHandler mints ids into a new reservation. The parameter ttl
+// gives the length of the reservation in seconds, and defaults to an hour.
+func ReserveHandler(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+
+	name := r.FormValue(":poolname")
+	count, err := mintCount(r)
+	if err != nil {
+		httpError(w, err, 400)
+		return
+	}
+	ttl := time.Hour
+	if s := r.FormValue("ttl"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil {
+			httpError(w, err, 400)
+			return
+		}
+		// checked before converting, which could overflow
+		if seconds <= 0 || time.Duration(seconds) > MaxReservationTTL/time.Second {
+			http.Error(w, "ttl is out of range", 400)
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	res, err := pools.PoolReserve(name, count, ttl)
+	if err != nil {
+		log.Println("Error:", err)
+		if err == NoSuchPool {
+			httpError(w, err, 404)
+		} else {
+			httpError(w, err, 400)
+		}
+		return
+	}
+	log.Println("Reserved", res.Token, res.Ids)
+	writeJSON(w, res)
+}
+
+func CommitHandler(w http.ResponseWriter, r *http.Request) {
+	handleReservation(w, r, pools.CommitReservation)
+}
+
+func ReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	handleReservation(w, r, pools.ReleaseReservation)
+}
+
+// handleReservation commits or releases the ids given by the id
+// parameters, or every id in the reservation if there are none.
+func handleReservation(w http.ResponseWriter, r *http.Request, finish func(name, token string, ids []string) ([]string, error)) {
+	logRequest(r)
+	name := r.FormValue(":poolname")
+	token := r.FormValue(":token")
+	ids, err := finish(name, token, r.Form["id"])
+	if err != nil {
+		log.Println("Error:", err)
+		switch err {
+		case NoSuchPool, NoSuchReservation:
+			httpError(w, err, 404)
+		case NotReserved:
+			httpError(w, err, 400)
+		default:
+			httpError(w, err, 500)
+		}
+		return
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	writeJSON(w, ids)
+}
+
 func AdvancePastHandler(w http.ResponseWriter, r *http.Request) {
 	logRequest(r)
 
@@ -118,7 +460,7 @@ func AdvancePastHandler(w http.ResponseWriter, r *http.Request) {
 	pi, err := pools.PoolAdvancePast(name, id)
 	if err != nil {
 		log.Println("Error:", err)
-		http.Error(w, err.Error(), 400)
+		httpError(w, err, 400)
 		return
 	}
 	writeJSON(w, pi)
@@ -127,16 +469,48 @@ func AdvancePastHandler(w http.ResponseWriter, r *http.Request) {
 // For now the stats provided are meager
 type stats struct {
 	Version string
+	Skipped []SkippedRecord `json:",omitempty"` // saved pools which could not be loaded
 }
 
 func StatsHandler(w http.ResponseWriter, r *http.Request) {
 	logRequest(r)
 	s := stats{
 		Version: Version,
+		Skipped: pools.Skipped(),
 	}
 	writeJSON(w, s)
 }
 
+type health struct {
+	Status        string          // "ok", or "degraded" if some pools are not working
+	Skipped       []SkippedRecord `json:",omitempty"`
+	DegradedPools []string        `json:",omitempty"`
+}
+
+// HealthHandler reports the pools which are not working. It returns 200
+// even then, since the other pools can still be used.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	h := health{
+		Status:        "ok",
+		Skipped:       pools.Skipped(),
+		DegradedPools: pools.DegradedPools(),
+	}
+	if len(h.Skipped) > 0 || len(h.DegradedPools) > 0 {
+		h.Status = "degraded"
+	}
+	writeJSON(w, h)
+}
+
+// httpError sends err to the client with the given status, except that
+// errors saving a pool have the status 503, since the request may be
+// retried once the store is working again.
+func httpError(w http.ResponseWriter, err error, status int) {
+	if _, ok := err.(*StoreError); ok {
+		status = 503
+	}
+	http.Error(w, err.Error(), status)
+}
+
 func logRequest(r *http.Request) {
 	log.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.RequestURI)
 }
@@ -167,14 +541,57 @@ func SetupHandlers(s PoolStore) {
 		}
 	}
 	r := pat.New()
+	// pat matches by prefix, so these must come before /pools/{poolname}
+	r.Get("/pools/{poolname}/ids/{id:.+}", IdShowHandler)
+	r.Put("/pools/{poolname}/ids/{id:.+}", IdBindHandler)
+	r.Get("/resolve/{poolname}/{id:.+}", ResolveHandler)
 	r.Get("/pools/{poolname}", PoolShowHandler)
+	r.Delete("/pools/{poolname}", PoolDeleteHandler)
+	r.Add("PATCH", "/pools/{poolname}", http.HandlerFunc(PoolUpdateHandler))
 	r.Put("/pools/{poolname}/open", PoolOpenHandler)
 	r.Put("/pools/{poolname}/close", PoolCloseHandler)
 	r.Post("/pools/{poolname}/mint", MintHandler)
 	r.Post("/pools/{poolname}/advancePast", AdvancePastHandler)
+	// this must come before /pools/{poolname}/reserve
+	r.Post("/pools/{poolname}/reservations/{token}/commit", CommitHandler)
+	r.Post("/pools/{poolname}/reservations/{token}/release", ReleaseHandler)
+	r.Post("/pools/{poolname}/reserve", ReserveHandler)
 	r.Get("/stats", StatsHandler)
+	r.Get("/health", HealthHandler)
+	r.Get("/tombstones", TombstonesHandler)
 	r.Get("/pools", PoolsHandler)
 	r.Post("/pools", NewPoolHandler)
 
-	http.Handle("/", r)
+	http.Handle("/", leaderOnly(r))
+}
+
+// A leaderStore is a PoolStore which only one server, the leader, may
+// change. LeaderURL returns the URL of the leader, and whether this
+// server is the leader.
+type leaderStore interface {
+	LeaderURL() (string, bool)
+}
+
+// leaderOnly redirects requests to the leader, if the store has one and
+// it is another server. The server statistics and health are always
+// answered.
+func leaderOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ls, ok := DefaultStore.(leaderStore)
+		if !ok || r.URL.Path == "/stats" || r.URL.Path == "/health" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		url, leader := ls.LeaderURL()
+		switch {
+		case leader:
+			h.ServeHTTP(w, r)
+		case url == "":
+			logRequest(r)
+			httpError(w, NoLeader, 503)
+		default:
+			// 307 keeps the method and body of the request
+			http.Redirect(w, r, strings.TrimSuffix(url, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		}
+	})
 }
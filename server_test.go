@@ -21,6 +21,7 @@ func TestEndToEnd(t *testing.T) {
 		{"POST", "/pools?name=qwe", 400, ""},
 		{"POST", "/pools?template=.sddd", 400, ""},
 		{"POST", "/pools?name=qwe&template=.bad", 400, "Bad Template String"},
+		{"POST", "/pools?name=a%20b&template=.sddd", 400, ""},
 		{"POST", "/pools?name=123&template=.rddddd", 201, ""},
 		{"GET", "/pools", 200, `["abc","123"]`},
 
@@ -31,18 +32,161 @@ func TestEndToEnd(t *testing.T) {
 		{"POST", "/pools/123/mint?n=5", 200, `["00000","00342","00684","01026","01368"]`},
 		// advance past
 		{"POST", "/pools/123/advancePast?id=12345", 200, ""},
+		{"POST", "/pools/123/advancePast?id=123", 400, `id "123": too short`},
+		{"POST", "/pools/123/advancePast?id=12b45", 400, `id "12b45": bad character 'b' at position 3`},
 		{"POST", "/pools/123/mint?n=5", 200, `["12687","13029","13371","13713","14055"]`},
 		// open and close
 		{"PUT", "/pools/123/close", 200, ""},
 		{"POST", "/pools/123/mint?n=5", 400, ""},
 		{"PUT", "/pools/123/open", 200, ""},
 		{"POST", "/pools/123/mint?n=5", 200, `["14397","14739","15081","15423","15765"]`},
+
+		// ARKs
+		{"POST", "/pools?name=ark&template=.sddeedk&naan=13030&shoulder=xf", 201, ""},
+		{"POST", "/pools?name=badark&template=.sddeedk&naan=13-30", 400, "Bad NAAN or shoulder"},
+		{"POST", "/pools/ark/mint?n=2", 200, `["ark:/13030/xf00000r","ark:/13030/xf000016"]`},
+		{"POST", "/pools/ark/advancePast?id=ark:/13030/xf93gt2q/page1", 200, ""},
+		{"POST", "/pools/ark/advancePast?id=xf00000r.pdf", 200, ""},
+		{"POST", "/pools/ark/advancePast?id=ark:/99999/xf00000r", 400, ""},
+
+		// bindings
+		{"PUT", "/pools/ark/ids/ark:/13030/xf00000r?target=http://example.org/1&title=One", 200, `{"target":"http://example.org/1","title":"One"}`},
+		{"GET", "/pools/ark/ids/xf00000r", 200, `{"target":"http://example.org/1","title":"One"}`},
+		{"PUT", "/pools/ark/ids/13030/xf00000r?title=", 200, `{"target":"http://example.org/1"}`},
+		{"GET", "/pools/ark/ids/ark:/13030/xf000016", 200, `{}`},
+		{"GET", "/pools/ark/ids/ark:/13030/xf00000x", 400, ""},
+		{"GET", "/pools/nope/ids/xf00000r", 404, ""},
+
+		// metadata
+		{"POST", "/pools?name=meta&template=.sd&owner=library&tag=project=curate", 201, ""},
+		{"POST", "/pools?name=meta2&template=.sd&tag=bad", 400, ""},
+		{"PATCH", "/pools/meta?description=test&tag=project=", 200, ""},
+		{"PATCH", "/pools/nope?description=test", 404, ""},
+		{"PATCH", "/pools/meta?exclude=1&excludePattern=[23]", 200, ""},
+		{"POST", "/pools/meta/mint?n=2", 200, `["0","4"]`},
+		{"PATCH", "/pools/meta?excludePattern=(", 400, ""},
+		{"PATCH", "/pools/meta?excludeWords=maybe", 400, ""},
+		{"POST", "/pools/meta/reserve?n=2&ttl=60", 200, ""},
+		{"POST", "/pools/meta/reserve?ttl=0", 400, ""},
+		{"POST", "/pools/meta/reserve?ttl=18446744074", 400, ""},
+		{"POST", "/pools/nope/reserve", 404, ""},
+		{"POST", "/pools/meta/reservations/nope/commit", 404, ""},
+		{"POST", "/pools/meta/reservations/nope/release", 404, ""},
+		{"PUT", "/pools/meta/close", 200, ""},
+		{"DELETE", "/pools/meta", 200, ""},
+
+		// deletion
+		{"DELETE", "/pools/abc", 403, ""},
+		{"PUT", "/pools/abc/close", 200, ""},
+		{"DELETE", "/pools/abc", 200, ""},
+		{"DELETE", "/pools/abc", 404, ""},
+		{"GET", "/pools/abc", 404, ""},
+		{"POST", "/pools?name=abc&template=.sddd", 409, ""},
+		{"GET", "/pools", 200, `["123","ark"]`},
 	}
 	for _, s := range sequence {
 		checkRoute(t, s.verb, s.route, s.status, s.expected)
 	}
 }
 
+func TestResolve(t *testing.T) {
+	pools.AddPool("resolve", ".sd")
+	pools.PoolMint("resolve", 3)
+	pools.SetBindings("resolve", "0", map[string]string{"target": "http://example.org/0"})
+	// only absolute http and https URLs may be bound as targets
+	checkRoute(t, "PUT", "/pools/resolve/ids/2?target=javascript:alert(1)", 400, "")
+	checkRoute(t, "PUT", "/pools/resolve/ids/2?target=//example.com/", 400, "")
+	// and no other target is redirected to
+	pools.SetBindings("resolve", "2", map[string]string{"target": "//example.com/"})
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	var tests = []struct {
+		route    string
+		status   int
+		location string
+	}{
+		{"/resolve/resolve/0", 302, "http://example.org/0"},
+		{"/resolve/resolve/1", 404, ""},
+		{"/resolve/resolve/2", 404, ""},
+		{"/resolve/resolve/5", 404, ""},
+		{"/resolve/resolve/x", 400, ""},
+	}
+	for _, test := range tests {
+		resp, err := client.Get(testServer.URL + test.route)
+		if err != nil {
+			t.Fatal(test.route, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status || resp.Header.Get("Location") != test.location {
+			t.Errorf("%s: Got %d %q\n", test.route, resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	pools.AddPool("idem", ".sddd")
+	mint := func(key, n string) (int, string) {
+		req, _ := http.NewRequest("POST", testServer.URL+"/pools/idem/mint?n="+n, nil)
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	status1, body1 := mint("key1", "2")
+	status2, body2 := mint("key1", "2")
+	if status1 != 200 || status2 != 200 || body1 != body2 {
+		t.Errorf("Got %d %s and %d %s\n", status1, body1, status2, body2)
+	}
+	if status, body := mint("key2", "2"); body != `["002","003"]`+"\n" {
+		t.Errorf("Got %d %s\n", status, body)
+	}
+	if status, _ := mint("key1", "3"); status != 422 {
+		t.Errorf("Got status %d for a reused key\n", status)
+	}
+}
+
+func TestStoreFailure(t *testing.T) {
+	store := &failStore{}
+	DefaultStore = store
+	pools.AddPool("unsaved", ".sd")
+	DefaultStore = NullStore{}
+
+	store.fail = true
+	checkRoute(t, "POST", "/pools/unsaved/mint", 503, "")
+	checkRoute(t, "PUT", "/pools/unsaved/close", 503, "")
+	store.fail = false
+	checkRoute(t, "POST", "/pools/unsaved/mint", 200, `["0"]`)
+}
+
+func TestHealth(t *testing.T) {
+	defer func(pg *poolGroup) { pools = pg }(pools)
+	pools = NewPoolGroup()
+	checkRoute(t, "GET", "/health", 200, `{"Status":"ok"}`)
+
+	pools.LoadPools([]PoolInfo{{Name: "good", Template: ".sd"}})
+	pools.LoadPoolsFromStore(&listStore{pis: []PoolInfo{{Name: "bad", Template: ".bad"}}})
+	checkRoute(t, "GET", "/health", 200, `{"Status":"degraded","Skipped":[{"Name":"bad","Error":"Bad Template String"}]}`)
+	checkRoute(t, "POST", "/pools/good/mint", 200, `["0"]`)
+}
+
+// listStore is a PoolStore holding the given pools
+type listStore struct {
+	NullStore
+	pis []PoolInfo
+}
+
+func (ls *listStore) LoadAllPools() ([]PoolInfo, error) {
+	return ls.pis, nil
+}
+
 func checkRoute(t *testing.T, verb, route string, status int, expected string) {
 	req, err := http.NewRequest(verb, testServer.URL+route, nil)
 	if err != nil {
@@ -79,6 +223,49 @@ func checkRoute(t *testing.T, verb, route string, status int, expected string) {
 	resp.Body.Close()
 }
 
+// followerStore is a PoolStore belonging to a server which is not the leader
+type followerStore struct {
+	NullStore
+	url string
+}
+
+func (fs followerStore) LeaderURL() (string, bool) {
+	return fs.url, false
+}
+
+func TestLeaderRedirect(t *testing.T) {
+	defer func() { DefaultStore = NullStore{} }()
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	var tests = []struct {
+		leader   string
+		method   string
+		route    string
+		status   int
+		location string
+	}{
+		{"http://leader:13001", "POST", "/pools/abc/mint?n=2", 307, "http://leader:13001/pools/abc/mint?n=2"},
+		{"http://leader:13001/", "GET", "/pools", 307, "http://leader:13001/pools"},
+		{"http://leader:13001", "GET", "/stats", 200, ""},
+		{"", "GET", "/pools", 503, ""},
+	}
+	for _, test := range tests {
+		DefaultStore = followerStore{url: test.leader}
+		req, _ := http.NewRequest(test.method, testServer.URL+test.route, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(test.route, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status || resp.Header.Get("Location") != test.location {
+			t.Errorf("%s: Got %d %q\n", test.route, resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+}
+
 var testServer *httptest.Server
 
 func init() {